@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"github.com/SashaCrofter/reltime"
+	"strings"
+	"time"
+)
+
+// ArchivedTask is a record of a task which has been completed, kept
+// in the Archive section of the fileList.
+type ArchivedTask struct {
+	// Completed is the time at which the task was marked done.
+	Completed time.Time
+
+	// Type is the kind of task which was completed, such as
+	// TypeDefinite.
+	Type string
+
+	// ID is the ID the task had before it was completed.
+	ID string `json:",omitempty"`
+
+	// Occurrence is the occurrence number of a completed recurring
+	// task.
+	Occurrence int `json:",omitempty"`
+
+	// Parent is the ID of the task which this was a subtask of.
+	Parent string `json:",omitempty"`
+
+	Priority          int
+	DueBy             time.Time
+	Name, Description string
+
+	Meta
+}
+
+// NewArchivedTask creates a record of the given Task being completed
+// at the given time.
+func NewArchivedTask(t Task, completed time.Time) *ArchivedTask {
+	info := t.Info()
+	return &ArchivedTask{
+		Completed:   completed,
+		Type:        info.Type,
+		ID:          info.ID,
+		Occurrence:  info.Occurrence,
+		Priority:    info.Priority,
+		DueBy:       info.DueBy,
+		Name:        info.Name,
+		Description: info.Description,
+		Meta:        info.Meta.stored(),
+	}
+}
+
+// Reopen produces a new task from the record, which can be added back
+// to the fileList. It keeps its ID, but is given a new alias. Recurring
+// tasks are reopened as definite tasks with the same due date and a new
+// ID, because their generator will not produce them again.
+func (a *ArchivedTask) Reopen() TaskContainer {
+	id := a.ID
+	if a.Type == TypeRecurring {
+		id = ""
+	}
+
+	if a.Type == TypeEventual {
+		return &EventualTask{
+			ID:          id,
+			Priority:    a.Priority,
+			Name:        a.Name,
+			Description: a.Description,
+			Meta:        a.Meta,
+		}
+	}
+	return &DefiniteTask{
+		ID:          id,
+		Priority:    a.Priority,
+		DueBy:       a.DueBy,
+		Name:        a.Name,
+		Description: a.Description,
+		Meta:        a.Meta,
+	}
+}
+
+// Contains checks whether the given search term appears anywhere in
+// the task's name or description, case-insensitively.
+func (a *ArchivedTask) Contains(term string) bool {
+	term = strings.ToLower(term)
+	return strings.Contains(strings.ToLower(a.Name), term) ||
+		strings.Contains(strings.ToLower(a.Description), term)
+}
+
+// ShortID gives the beginning of the record's ID, which is enough to
+// identify it, followed by the occurrence of a recurring task, since
+// every occurrence shares the ID of its generator.
+func (a *ArchivedTask) ShortID() string {
+	id, occurrence := a.ID, ""
+	if i := strings.LastIndex(id, ":"); i >= 0 {
+		id, occurrence = id[:i], id[i:]
+	}
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	return id + occurrence
+}
+
+// String formats the record in a brief list-friendly format, led by
+// the time of completion.
+func (a *ArchivedTask) String() string {
+	due := ""
+	if !a.DueBy.IsZero() {
+		due = " " + reltime.FormatRelative(RelFmt, DueFmt, a.DueBy)
+	}
+	return fmt.Sprintf("%s  %s  (%d)%s - %s%s\n",
+		a.Completed.Format(FullFormat), a.ShortID(), a.Priority, due,
+		a.Name, a.Labels())
+}
+
+// FindArchived locates the single record in the Archive identified by
+// the search term, which may be its ID, a prefix of it, the short ID
+// shown by String, or its name or a prefix of it. As with Find, if
+// more than one matches, then an *AmbiguousError listing them, most
+// recently completed first, is returned.
+func (fl *fileList) FindArchived(term string) (*ArchivedTask, error) {
+	term = strings.ToLower(strings.TrimSpace(term))
+	if term == "" {
+		return nil, ErrNoTaskGiven
+	}
+
+	matchers := []func(*ArchivedTask) bool{
+		func(a *ArchivedTask) bool {
+			return term == a.ID || term == a.ShortID() ||
+				(len(term) >= MinIDPrefix && strings.HasPrefix(a.ID, term))
+		},
+		func(a *ArchivedTask) bool { return strings.EqualFold(a.Name, term) },
+		func(a *ArchivedTask) bool {
+			return strings.HasPrefix(strings.ToLower(a.Name), term)
+		},
+	}
+
+	for _, matches := range matchers {
+		var found []*ArchivedTask
+		for i := len(fl.Archive) - 1; i >= 0; i-- {
+			if matches(fl.Archive[i]) {
+				found = append(found, fl.Archive[i])
+			}
+		}
+
+		switch len(found) {
+		case 0:
+			continue
+		case 1:
+			return found[0], nil
+		default:
+			err := &AmbiguousError{Term: term}
+			for _, a := range found {
+				err.Candidates = append(err.Candidates,
+					TaskInfo{ID: a.ID, Alias: a.ShortID(), Name: a.Name})
+			}
+			return nil, err
+		}
+	}
+	return nil, ErrNoArchivedTask
+}
+
+// Complete marks the given Task done, removing it from the fileList,
+// and keeps a record of it in the Archive. Tasks which depended on it
+// no longer do. If it had subtasks which are no longer listed, they
+// are completed as well.
+func (fl *fileList) Complete(t Task, completed time.Time) {
+	c := containerOf(t)
+	fl.archive(t, fl.parentOf(c), completed)
+	t.Done(fl)
+	fl.unblock(t)
+
+	if !fl.Contains(c) {
+		fl.completeSubtasks(c, completed)
+	}
+}
+
+// archive keeps a record of the given Task, which is a subtask of the
+// given parent if it is not nil, being completed.
+func (fl *fileList) archive(t Task, parent TaskContainer,
+	completed time.Time) {
+
+	a := NewArchivedTask(t, completed)
+	a.Parent = containerID(parent)
+	fl.Archive = append(fl.Archive, a)
+}
+
+// Reopen removes the given record from the Archive and adds the task
+// it describes back to the fileList, as a subtask of the task it
+// belonged to if that is still there.
+func (fl *fileList) Reopen(a *ArchivedTask) {
+	for i, archived := range fl.Archive {
+		if archived == a {
+			fl.Archive = append(fl.Archive[:i], fl.Archive[i+1:]...)
+			break
+		}
+	}
+
+	fl.AddSubtask(fl.container(a.Parent), a.Reopen())
+}
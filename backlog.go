@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BacklogAll      = "all"
+	BacklogLatest   = "latest"
+	BacklogCollapse = "collapse"
+
+	// BacklogPrefix begins an argument to recurring which sets the
+	// BacklogPolicy of the new task.
+	BacklogPrefix = "backlog:"
+)
+
+// BacklogPolicy determines which of the missed tasks of a recurring
+// task are listed. Missed tasks are those which are past their due
+// date, but have not been completed. With BacklogAll, they all are.
+// With BacklogLatest, only the latest Keep are, and with
+// BacklogCollapse, only the latest is, standing for all of them. Missed
+// tasks which are hidden are dropped when a later one is completed.
+type BacklogPolicy struct {
+	Mode string
+	Keep int `json:",omitempty"`
+}
+
+// ParseBacklogPolicy parses a policy in the form "all", "collapse",
+// "latest", or "latest:N", where N is the number of missed tasks to
+// keep, and is 1 if not given.
+func ParseBacklogPolicy(s string) (*BacklogPolicy, error) {
+	fields := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return r == ':' || r == ' '
+	})
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no backlog policy given")
+	}
+
+	p := &BacklogPolicy{Mode: fields[0]}
+	switch {
+	case p.Mode == BacklogLatest && len(fields) == 1:
+		p.Keep = 1
+	case p.Mode == BacklogLatest && len(fields) == 2:
+		keep, err := strconv.Atoi(fields[1])
+		if err != nil || keep < 1 {
+			return nil, fmt.Errorf("invalid number of tasks to keep %q",
+				fields[1])
+		}
+		p.Keep = keep
+	case (p.Mode == BacklogAll || p.Mode == BacklogCollapse) &&
+		len(fields) == 1:
+	default:
+		return nil, fmt.Errorf("unknown backlog policy %q", s)
+	}
+
+	// Keeping all missed tasks is the default.
+	if p.Mode == BacklogAll {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// String produces the policy in the form understood by
+// ParseBacklogPolicy.
+func (p *BacklogPolicy) String() string {
+	if p == nil {
+		return BacklogAll
+	}
+	if p.Mode == BacklogLatest {
+		return fmt.Sprintf("%s:%d", p.Mode, p.Keep)
+	}
+	return p.Mode
+}
+
+// backlog separates the given occurrences into those which are shown,
+// in order, and the missed ones which the Backlog policy hides, as of
+// the given time.
+func (g *RecurringTaskGenerator) backlog(occurrences []int,
+	now time.Time) (shown, hidden []int) {
+
+	sort.Ints(occurrences)
+	if g.Backlog == nil {
+		return occurrences, nil
+	}
+
+	var missed []int
+	for _, id := range occurrences {
+		if g.SpawnTask(id).DueBy.Before(now) {
+			missed = append(missed, id)
+		} else {
+			shown = append(shown, id)
+		}
+	}
+
+	keep := 1
+	if g.Backlog.Mode == BacklogLatest {
+		keep = g.Backlog.Keep
+	}
+	if len(missed) > keep {
+		hidden, missed = missed[:len(missed)-keep], missed[len(missed)-keep:]
+	}
+	return append(missed, shown...), hidden
+}
+
+// hiddenBefore returns the missed occurrences earlier than the given
+// one which the Backlog policy hides.
+func (g *RecurringTaskGenerator) hiddenBefore(occurrence int,
+	now time.Time) (ids []int) {
+
+	_, hidden := g.backlog(g.outstanding(now), now)
+	for _, id := range hidden {
+		if id < occurrence {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
+// dropExceptions removes the given occurrences from the exceptions, so
+// that they are considered complete.
+func (g *RecurringTaskGenerator) dropExceptions(ids []int) {
+	drop := make(map[int]bool)
+	for _, id := range ids {
+		drop[id] = true
+	}
+	except := g.Except[:0]
+	for _, id := range g.Except {
+		if !drop[id] {
+			except = append(except, id)
+		}
+	}
+	g.Except = except
+}
+
+// missedLabel annotates a task which stands for a number of missed
+// tasks.
+func missedLabel(missed int) string {
+	if missed == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (missed %d)", missed)
+}
+
+func (c *Command) CmdCatchup(ctx *Context) (err error) {
+	glog.V(2).Infoln("User invoked catchup")
+
+	// The recurring task may be given by the alias of its generator,
+	// which matches all of its outstanding tasks.
+	task, err := ctx.List.Find(strings.Join(c.Args, " "))
+	if amb, ok := err.(*AmbiguousError); ok {
+		if tasks := ctx.List.sameContainer(amb); tasks != nil {
+			task, err = tasks[0], nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	t, ok := task.(*RecurringTask)
+	if !ok {
+		return ErrNotRecurring
+	}
+
+	// Complete every missed task but the latest, including any which
+	// the backlog policy hides, from the oldest.
+	g, now := t.parent, ctx.Now()
+	ids := g.outstanding(now)
+	sort.Ints(ids)
+	var missed []int
+	for _, id := range ids {
+		if g.SpawnTask(id).DueBy.Before(now) {
+			missed = append(missed, id)
+		}
+	}
+	if len(missed) < 2 {
+		fmt.Fprintf(ctx.Output, "No missed tasks to catch up on\n")
+		return nil
+	}
+
+	for _, id := range missed[:len(missed)-1] {
+		ctx.fileList.Complete(g.SpawnTask(id), now)
+	}
+	ctx.modified = true
+
+	fmt.Fprintf(ctx.Output, "Caught up on %d missed tasks\n",
+		len(missed)-1)
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// BackupSuffix is inserted between the path of a list and the
+	// generation number to form the path of a backup.
+	BackupSuffix = ".bak."
+)
+
+// Backup describes a single backup generation of a task list.
+type Backup struct {
+	// Generation is the 1-indexed age of the backup, with 1 being the
+	// most recent.
+	Generation int
+
+	Path    string
+	ModTime time.Time
+}
+
+// BackupPath returns the path of the given backup generation of the
+// list at path.
+func BackupPath(path string, generation int) string {
+	return path + BackupSuffix + strconv.Itoa(generation)
+}
+
+// RotateBackups shifts every existing backup of the list at path one
+// generation older, discarding any beyond the given number of
+// generations, and then copies the list itself to the first
+// generation. If generations is less than one, or the list does not
+// exist, it does nothing.
+func RotateBackups(path string, generations int) error {
+	if generations < 1 {
+		return nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	// Remove the oldest generation, and any left over from a time
+	// when more generations were kept, then move each of the
+	// remaining ones back by one.
+	backups, err := ListBackups(path)
+	if err != nil {
+		return err
+	}
+	for _, b := range backups {
+		if b.Generation >= generations {
+			if err = os.Remove(b.Path); err != nil {
+				return err
+			}
+		}
+	}
+	for i := generations - 1; i >= 1; i-- {
+		err = os.Rename(BackupPath(path, i), BackupPath(path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return copyFile(BackupPath(path, 1), path)
+}
+
+// ListBackups finds all backups of the list at path, and returns them
+// sorted from newest to oldest.
+func ListBackups(path string) (backups []Backup, err error) {
+	matches, err := filepath.Glob(path + BackupSuffix + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, match := range matches {
+		// Ignore anything which doesn't end in a generation number.
+		generation, err := strconv.Atoi(
+			strings.TrimPrefix(match, path+BackupSuffix))
+		if err != nil || generation < 1 {
+			continue
+		}
+
+		info, err := os.Stat(match)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, Backup{
+			Generation: generation,
+			Path:       match,
+			ModTime:    info.ModTime(),
+		})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Generation < backups[j].Generation
+	})
+	return backups, nil
+}
+
+// copyFile copies the contents and permissions of the file at src to
+// dst, which is created or truncated, and syncs it to disk.
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// describeBackup produces a one-line summary of a backup, including
+// the number of tasks it contains, for use in the restore command.
+func describeBackup(b Backup) string {
+	summary := "unreadable"
+	fl, _, err := ReadListFile(b.Path)
+	if err == nil {
+		summary = fmt.Sprintf("%d definite, %d eventual, %d recurring",
+			len(fl.Definite), len(fl.Eventual), len(fl.Recurring))
+	}
+
+	return fmt.Sprintf("%3d  %s  (%s)\n",
+		b.Generation, b.ModTime.Format(FullFormat), summary)
+}
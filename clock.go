@@ -0,0 +1,35 @@
+package main
+
+import (
+	"time"
+)
+
+// Clock tells the time, so that commands can be run as though it were
+// some other time.
+type Clock interface {
+	Now() time.Time
+}
+
+// FixedClock is a Clock which is stopped at a particular time.
+type FixedClock time.Time
+
+// Now returns the time at which the clock is stopped.
+func (c FixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+// Now returns the current time according to the Clock of the Context,
+// or the actual time if it has none.
+func (ctx *Context) Now() time.Time {
+	if ctx == nil || ctx.Clock == nil {
+		return time.Now()
+	}
+	return ctx.Clock.Now()
+}
+
+// Now returns the current time according to the Clock of the global
+// Context. It is used where there is no Context at hand, such as when
+// sorting tasks.
+func Now() time.Time {
+	return Ctx.Now()
+}
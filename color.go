@@ -41,7 +41,7 @@ func BrushConditionally(ctx *Context, brush color.Brush) color.Brush {
 // urgency.
 func ColorForDate(dueby time.Time, threshold time.Duration) color.Brush {
 	// Determine how far away the due date is.
-	distance := dueby.Sub(time.Now())
+	distance := dueby.Sub(Now())
 
 	// Determine which paint to use by finding the number of times the
 	// threshold goes into the distance.
@@ -7,7 +7,6 @@ import (
 	"io"
 	"strconv"
 	"strings"
-	"time"
 )
 
 import ()
@@ -15,6 +14,10 @@ import ()
 const (
 	DueFormat  = "Jan _2 15:04"
 	FullFormat = "2006-01-02 15:04"
+
+	// DescriptionPrefix begins an argument which starts a task
+	// description.
+	DescriptionPrefix = "desc:"
 )
 
 var (
@@ -24,9 +27,18 @@ var (
 	ErrMissingPriority = errors.New("no priority argument given")
 
 	ErrNoTasks = errors.New("no tasks in list")
+
+	ErrNoArchivedTask = errors.New("no matching archived task")
+
+	ErrNoBackups     = errors.New("no backups of list")
+	ErrUnknownBackup = errors.New("no such backup")
 )
 
 type Command struct {
+	// Name is the command string which was used to select the
+	// Runner.
+	Name string
+
 	// Run is the function underlying the Command, and can be called
 	// to execute the behavior of the Command.
 	Run Runner
@@ -54,6 +66,26 @@ var RunMap = map[string]Runner{
 	"r":          (*Command).CmdRecurring,
 	"done":       (*Command).CmdDone,
 	"d":          (*Command).CmdDone,
+	"restore":    (*Command).CmdRestore,
+	"undo":       (*Command).CmdUndo,
+	"u":          (*Command).CmdUndo,
+	"redo":       (*Command).CmdRedo,
+	"archive":    (*Command).CmdArchive,
+	"log":        (*Command).CmdArchive,
+	"reopen":     (*Command).CmdReopen,
+	"why":        (*Command).CmdWhy,
+	"show":       (*Command).CmdShow,
+	"s":          (*Command).CmdShow,
+	"modify":     (*Command).CmdModify,
+	"m":          (*Command).CmdModify,
+	"edit":       (*Command).CmdEdit,
+	"skip":       (*Command).CmdSkip,
+	"reschedule": (*Command).CmdReschedule,
+	"override":   (*Command).CmdOverride,
+	"catchup":    (*Command).CmdCatchup,
+	"export":     (*Command).CmdExport,
+	"import":     (*Command).CmdImport,
+	"serve":      (*Command).CmdServe,
 }
 
 // ParseCommand constructs a command based on a set of arguments,
@@ -76,23 +108,96 @@ func ParseCommand(args []string) (c *Command, err error) {
 		return c, ErrUnknownCommand
 	}
 
+	c.Name = args[0]
 	c.Args = args[1:]
 	return
 }
 
+// String reconstructs the command line from which the Command was
+// parsed.
+func (c *Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
 type Runner func(*Command, *Context) error
 
+// SplitDescription separates a task description from the rest of the
+// arguments. The description is everything after a "--" argument, or
+// everything from an argument beginning with "desc:", with the prefix
+// removed. If neither is present, given is false.
+func SplitDescription(args []string) (rest []string, description string,
+	given bool) {
+
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], strings.Join(args[i+1:], " "), true
+		} else if strings.HasPrefix(arg, DescriptionPrefix) {
+			words := append([]string{
+				strings.TrimPrefix(arg, DescriptionPrefix)}, args[i+1:]...)
+			return args[:i], strings.TrimSpace(strings.Join(words, " ")), true
+		}
+	}
+	return args, "", false
+}
+
+// describe returns the given description if there is one. Otherwise,
+// in interactive mode, it prompts for one, and reads lines from the
+// Input until an empty one. The lock on the list is not held while it
+// waits, so it must be called before anything is found in the list.
+func (ctx *Context) describe(description string, given bool) (string, error) {
+	if given || !ctx.Interactive {
+		return description, nil
+	}
+
+	var lines []string
+	err := ctx.await(func() error {
+		writePrompt(ctx, "Description (end with an empty line):\n")
+		for {
+			writePrompt(ctx, DescriptionPromptString)
+			line, err := ctx.Input.ReadString('\n')
+			line = strings.TrimRight(line, "\r\n")
+			if line != "" {
+				lines = append(lines, line)
+			}
+
+			if err == io.EOF || (err == nil && line == "") {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	})
+	return strings.Join(lines, "\n"), err
+}
+
 func (c *Command) CmdHelp(ctx *Context) (err error) {
 	glog.V(2).Infoln("User invoked help")
 
 	fmt.Fprintf(ctx.Output, "TaskToDo version %s\n\n", Version)
 	fmt.Fprintf(ctx.Output, "    help\t\t\t\t\t- print this menu\n")
 	fmt.Fprintf(ctx.Output, "    exit\t\t\t\t\t- exit gracefully\n")
-	fmt.Fprintf(ctx.Output, "    list [maxItems]\t\t\t\t- list all tasks\n")
-	fmt.Fprintf(ctx.Output, "    add name priority month day hr:min\t- add a task\n")
-	fmt.Fprintf(ctx.Output, "    eventually name priority\t\t- add an eventual task\n")
-	fmt.Fprintf(ctx.Output, "    recurring name priority start [end] delay[,delay] - add an eventual task\n")
-	fmt.Fprintf(ctx.Output, "    done name\t\t\t\t- complete a task\n")
+	fmt.Fprintf(ctx.Output, "    list [filter] [maxItems]\t\t- list all tasks\n")
+	fmt.Fprintf(ctx.Output, "    add name priority date [-- desc]\t- add a task\n")
+	fmt.Fprintf(ctx.Output, "    eventually name priority [-- desc]\t- add an eventual task\n")
+	fmt.Fprintf(ctx.Output, "    recurring name priority start [until end] [after:]delay[,delay]|rule\n\t  [backlog:policy] [-- desc]\t- add a recurring task\n")
+	fmt.Fprintf(ctx.Output, "      (give parent:task to add a subtask)\n")
+	fmt.Fprintf(ctx.Output, "    show task\t\t\t\t- show a task in full\n")
+	fmt.Fprintf(ctx.Output, "    why task\t\t\t\t- explain a task's urgency\n")
+	fmt.Fprintf(ctx.Output, "    done task|filter\t\t\t- complete tasks\n")
+	fmt.Fprintf(ctx.Output, "    modify task|filter field=value...\t- change tasks\n")
+	fmt.Fprintf(ctx.Output, "    edit task\t\t\t\t- edit a task in $EDITOR\n")
+	fmt.Fprintf(ctx.Output, "    skip task\t\t\t\t- skip one recurring task\n")
+	fmt.Fprintf(ctx.Output, "    reschedule task date\t\t- move one recurring task\n")
+	fmt.Fprintf(ctx.Output, "    override task field=value...\t- change one recurring task\n")
+	fmt.Fprintf(ctx.Output, "    catchup task\t\t\t- complete all but the latest missed\n")
+	fmt.Fprintf(ctx.Output, "    archive [search]\t\t\t- list completed tasks\n")
+	fmt.Fprintf(ctx.Output, "    reopen task\t\t\t\t- reopen a completed task\n")
+	fmt.Fprintf(ctx.Output, "    export format [file] [filter]\t- export tasks (ical, taskwarrior, todotxt)\n")
+	fmt.Fprintf(ctx.Output, "    import format file\t\t\t- import tasks (ical, taskwarrior, todotxt)\n")
+	fmt.Fprintf(ctx.Output, "    serve [--addr host:port]\t\t- serve tasks over HTTP\n")
+	fmt.Fprintf(ctx.Output, "    restore [backup]\t\t\t- list or restore backups\n")
+	fmt.Fprintf(ctx.Output, "    undo [count]\t\t\t- undo the last change\n")
+	fmt.Fprintf(ctx.Output, "    redo [count]\t\t\t- redo an undone change\n")
 
 	return nil
 }
@@ -114,13 +219,31 @@ func (c *Command) CmdList(ctx *Context) (err error) {
 		return ErrNoTasks
 	}
 
+	// Only show tasks which match the filter, if one is given.
+	filter, args, err := ParseFilter(c.Args, ctx.Now())
+	if err != nil {
+		return err
+	}
+	tasks := ctx.List.Filter(filter)
+
+	// Blocked tasks may be hidden, unless they are asked for.
+	if ctx.HideBlocked && !filter.Blocked() {
+		var unblocked List
+		for _, t := range tasks {
+			if len(t.Metadata().blockers) == 0 {
+				unblocked = append(unblocked, t)
+			}
+		}
+		tasks = unblocked
+	}
+
 	// Only show the first n tasks, but make sure that n doesn't go
 	// out of bounds. Also, if n is -1, show all tasks.
 	var n int
 
 	// If an argument is given, then try to use it.
-	if len(c.Args) > 0 {
-		n, _ = strconv.Atoi(c.Args[0])
+	if len(args) > 0 {
+		n, _ = strconv.Atoi(args[0])
 	}
 
 	// If not, then use the context's setting.
@@ -128,12 +251,26 @@ func (c *Command) CmdList(ctx *Context) (err error) {
 		n = ctx.MaxListItems
 	}
 
-	if n > len(ctx.List) || n < 0 {
-		n = len(ctx.List)
+	if n > len(tasks) || n < 0 {
+		n = len(tasks)
 	}
 
-	for _, task := range ctx.List[:n] {
-		_, err = io.WriteString(ctx.Output, task.String())
+	if ctx.Structured() {
+		if ctx.records == nil {
+			ctx.records = make([]Record, 0, n)
+		}
+		for _, task := range tasks[:n] {
+			ctx.emitTask(EventListed, task)
+		}
+		return nil
+	}
+
+	for _, task := range tasks[:n] {
+		line, err := ctx.renderTask(task)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprint(ctx.Output, line)
 		if err != nil {
 			glog.Warningf("Error listing tasks: %s\n", err)
 		}
@@ -147,10 +284,28 @@ func (c *Command) CmdAdd(ctx *Context) (err error) {
 
 	t := &DefiniteTask{}
 	var datestring string
+
+	// The description is asked for before anything is found in the
+	// list, which may be reloaded while waiting for it.
+	args, description, hasDescription := SplitDescription(c.Args)
+	t.Description, err = ctx.describe(description, hasDescription)
+	if err != nil {
+		return err
+	}
+	args, parent, err := ctx.extractParent(args)
+	if err != nil {
+		return err
+	}
+	args, t.Meta = ExtractMeta(args)
+	t.Depends, err = ctx.List.ResolveDepends(t.Depends)
+	if err != nil {
+		return err
+	}
 	// Separate the arguments into sections and fill out the Task with
-	// them. The syntax is "add [multiword name] [priority] [month-day
-	// hour:minute]".
-	for _, arg := range c.Args {
+	// them. The syntax is "add [multiword name] [priority] [date]
+	// [-- description]", where the date is anything understood by
+	// ParseDate.
+	for _, arg := range args {
 		// If the Priority has not yet been filled out, try to parse
 		// the current argument as an int. Otherwise, append the
 		// argument to the datestring to be parsed at the end.
@@ -167,28 +322,20 @@ func (c *Command) CmdAdd(ctx *Context) (err error) {
 	}
 	t.Name = strings.TrimRight(t.Name, " ")
 
-	due, err := time.ParseInLocation(DueFormat,
-		strings.TrimRight(datestring, " "), time.Local)
+	t.DueBy, err = ParseDate(datestring, ctx.Now())
 	if err != nil {
-		return errors.New("Could not parse arguments")
-	}
-	// Use the next occurrence of this date by first parsing it as if
-	// it's in the current calendar year, or if that is before the
-	// current time, then shifting it to the next calendar year.
-	currentTime := time.Now()
-	due = due.AddDate(currentTime.Year(), 0, 0)
-	if due.Before(currentTime) {
-		due = due.AddDate(1, 0, 0)
+		return err
 	}
 
-	t.DueBy = due.Local()
-
-	// TODO: retrieve a description somehow
+	if err = Validate(t); err != nil {
+		return err
+	}
 
 	// Now, add the task to the list, sort it, and set the "modified"
 	// flag.
-	ctx.fileList.Definite = append(ctx.fileList.Definite, t)
+	ctx.fileList.AddSubtask(parent, t)
 	ctx.modified = true
+	ctx.emitAdded(t)
 	return nil
 }
 
@@ -196,11 +343,25 @@ func (c *Command) CmdEventually(ctx *Context) (err error) {
 	glog.V(2).Infoln("User invoked eventually")
 
 	t := &EventualTask{}
+	args, description, hasDescription := SplitDescription(c.Args)
+	t.Description, err = ctx.describe(description, hasDescription)
+	if err != nil {
+		return err
+	}
+	args, parent, err := ctx.extractParent(args)
+	if err != nil {
+		return err
+	}
+	args, t.Meta = ExtractMeta(args)
+	t.Depends, err = ctx.List.ResolveDepends(t.Depends)
+	if err != nil {
+		return err
+	}
 	// Loop through the arguments until we find a priority factor,
 	// which will be just an integer. The syntax is as follows.
 	//
-	//     eventually [Name] [priority]
-	for _, arg := range c.Args {
+	//     eventually [Name] [priority] [-- description]
+	for _, arg := range args {
 		// If the Priority has not yet been filled out, try to parse
 		// the current argument as an int.
 		if t.Priority == 0 {
@@ -220,10 +381,12 @@ func (c *Command) CmdEventually(ctx *Context) (err error) {
 
 	t.Name = strings.TrimRight(t.Name, " ")
 
-	// TODO: retrieve a description somehow
-
-	ctx.fileList.Eventual = append(ctx.fileList.Eventual, t)
+	if err = Validate(t); err != nil {
+		return err
+	}
+	ctx.fileList.AddSubtask(parent, t)
 	ctx.modified = true
+	ctx.emitAdded(t)
 	return nil
 }
 
@@ -231,99 +394,100 @@ func (c *Command) CmdRecurring(ctx *Context) (err error) {
 	glog.V(2).Infoln("User invoked recurring")
 
 	t := &RecurringTaskGenerator{}
+	args, description, hasDescription := SplitDescription(c.Args)
+	t.Spawn.Description, err = ctx.describe(description, hasDescription)
+	if err != nil {
+		return err
+	}
+	args, parent, err := ctx.extractParent(args)
+	if err != nil {
+		return err
+	}
+	args, t.Spawn.Meta = ExtractMeta(args)
+	t.Spawn.Depends, err = ctx.List.ResolveDepends(t.Spawn.Depends)
+	if err != nil {
+		return err
+	}
 
-	// The format for this command is
-	//
-	//     recurring task name priority start [end] delay[,delay]
-	//
-	// The start and end arguments are three fields each - Jan 27
-	// 12:00, for example. We need to loop from the back, processing
-	// first the delay(s), then the end date if provided, then the
-	// start date, then the priority and task name.
-
-	for i := len(c.Args) - 1; i >= 0; i-- {
-		arg := c.Args[i]
-
-		switch {
-		case t.Delay == nil: // process delay[,delay]
-			for _, delaystr := range strings.Split(arg, ",") {
-				// If the delay can be parsed, append it to the
-				// slice. If there not, report the error.
-				delay, err := time.ParseDuration(delaystr)
-				if err != nil {
-					return err
-				}
-				t.Delay = append(t.Delay, delay)
-			}
-
-		case t.End.IsZero() && t.Start.IsZero(): // process End
-			// If there aren't enough remaining arguments, give an
-			// error.
-			if i < 1 {
-				return errors.New("Could not parse arguments")
-			}
-			// Otherwise, construct a timestr and move the iterator.
-			timestr := c.Args[i-1] + " " + arg
-			i -= 1
-
-			// Interpret the set as the End. If parsing the Start
-			// fails, then this will be used as the Start instead and
-			// the End will be zeroed.
-			t.End, err = time.ParseInLocation(FullFormat,
-				timestr, time.Local)
+	// A policy for missed tasks may be given anywhere, as
+	// "backlog:policy".
+	var rest []string
+	for _, arg := range args {
+		if strings.HasPrefix(strings.ToLower(arg), BacklogPrefix) {
+			t.Backlog, err = ParseBacklogPolicy(arg[len(BacklogPrefix):])
 			if err != nil {
 				return err
 			}
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	args = rest
 
-		case t.Start.IsZero(): // process Start
-			// If there aren't enough remaining arguments, give an
-			// error.
-			if i < 1 {
-				return errors.New("Could not parse arguments")
-			}
-			// Otherwise construct a timestr, but wait on moving the
-			// iterator until this parses successfully as a time.
-			timestr := c.Args[i-1] + " " + arg
-
-			// Try to parse it.
-			t.Start, err = time.ParseInLocation(FullFormat,
-				timestr, time.Local)
-			if err != nil {
-				// If there is an error, use the End instead, if that
-				// exists, and prevent i from being decremented by
-				// this pass.
-				if !t.End.IsZero() {
-					t.Start = t.End
-					t.End = time.Time{}
-					i += 1
-				} else {
-					return err
-				}
-			} else {
-				// Otherwise, use the newly parsed time and decrement
-				// i appropriately.
-				i -= 1
-			}
+	// The format for this command is
+	//
+	//     recurring task name priority start [[until] end] delay[,delay]
+	//         [-- description]
+	//
+	// The delay(s), or a recurrence rule in place of them, are the last
+	// argument, which is prefixed with "after:" if the task recurs
+	// relative to when it was last completed, and the priority is the
+	// first integer, with the name before it. The arguments in
+	// between are the start date, and optionally the end date, in any
+	// format understood by ParseDate.
+	if len(args) == 0 {
+		return errors.New("Could not parse arguments")
+	}
+	last := args[len(args)-1]
+	if strings.HasPrefix(strings.ToLower(last), AfterCompletionPrefix) {
+		t.AfterCompletion = true
+		last = last[len(AfterCompletionPrefix):]
+	}
+	if IsRule(last) {
+		t.Rule, err = ParseRRule(last)
+	} else {
+		t.Delay, err = ParseDelays(last)
+	}
+	if err != nil {
+		return err
+	}
+	if t.AfterCompletion && t.Rule != nil {
+		return ErrRuleAfterCompletion
+	}
 
-		case t.Spawn.Priority == 0: // process Spawn Priority
-			// Try to process the priority. If we've gotten to this
-			// point, and it doesn't work, then it is a fatal error.
+	var dates []string
+	for _, arg := range args[:len(args)-1] {
+		if t.Spawn.Priority == 0 {
 			t.Spawn.Priority, err = strconv.Atoi(arg)
 			if err != nil {
-				return
+				// If the priority couldn't be parsed, consider it
+				// part of the name.
+				t.Spawn.Name += arg + " "
 			}
-
-		default: // process Spawn Name
-			// If all other conditions have been satisfied, add it to
-			// the name (in reverse order.)
-			t.Spawn.Name = arg + " " + t.Spawn.Name
+		} else {
+			dates = append(dates, arg)
 		}
 	}
+	if t.Spawn.Priority == 0 {
+		return ErrMissingPriority
+	}
+
+	t.Start, t.End, err = ParseDateRange(dates, ctx.Now())
+	if err != nil {
+		return err
+	}
+
+	t.Spawn.Name = strings.TrimRight(t.Spawn.Name, " ")
+
+	if err = Validate(t); err != nil {
+		return err
+	}
 
 	// Append the task to the appropriate fileList field and mark it
 	// as modified.
-	ctx.fileList.Recurring = append(ctx.fileList.Recurring, t)
+	ctx.fileList.AddSubtask(parent, t)
 	ctx.modified = true
+	ctx.emitAdded(t)
 
 	return nil
 }
@@ -331,18 +495,225 @@ func (c *Command) CmdRecurring(ctx *Context) (err error) {
 func (c *Command) CmdDone(ctx *Context) (err error) {
 	glog.V(2).Infoln("User invoked done")
 
-	// Re-combine the arguments into a single prefix string to search
-	// for.
-	searchterm := strings.ToLower(strings.Join(c.Args, " "))
-
-	// Iterate through the List and remove the first Task for which
-	// the searchterm matches the start of the string.
-	for _, task := range ctx.List {
-		if task.Match(searchterm) {
-			task.Done(&Ctx.fileList)
-			Ctx.modified = true
-			return nil
+	// Complete the task which the arguments identify, or every task
+	// matching them if they contain a filter.
+	tasks, err := ctx.List.Select(c.Args, ctx.Now())
+	if err != nil {
+		return err
+	}
+
+	// Remember which tasks are blocked, so that those which are no
+	// longer blocked afterward can be reported.
+	blocked := make(map[string]bool)
+	for _, t := range ctx.List {
+		if len(t.Metadata().blockers) > 0 {
+			blocked[t.Info().ID] = true
+		}
+	}
+
+	completed := make(map[Task]bool)
+	for _, task := range tasks {
+		// Completing a task before those it depends on is allowed,
+		// but is probably a mistake.
+		if cycle := dependencyCycle(task); cycle != nil {
+			ctx.warn("dependency cycle %s\n", formatCycle(cycle))
+		} else if open := openBlockers(task, completed); len(open) > 0 {
+			ctx.warn("%q is still blocked by %s\n", task.Info().Name, blockerAliases(open))
+		}
+
+		parent := ctx.fileList.parentOf(containerOf(task))
+		ctx.fileList.Complete(task, ctx.Now())
+		completed[task] = true
+		ctx.reportCompleted(task, len(tasks) > 1)
+
+		// Completing the last subtask of a task may complete it as
+		// well, and so on up to the top.
+		for ctx.CompleteParents && parent != nil &&
+			parent.Children().Empty() && ctx.fileList.Contains(parent) {
+
+			t := ctx.List.taskOf(parent)
+			if t == nil || completed[t] {
+				break
+			}
+			next := ctx.fileList.parentOf(parent)
+			ctx.fileList.Complete(t, ctx.Now())
+			completed[t] = true
+			ctx.reportCompleted(t, true)
+			parent = next
+		}
+	}
+	ctx.modified = true
+
+	for _, t := range ctx.fileList.List() {
+		if !blocked[t.Info().ID] || len(t.Metadata().blockers) > 0 {
+			continue
+		}
+		if ctx.Structured() {
+			ctx.emitTask(EventUnblocked, t)
+		} else {
+			fmt.Fprintf(ctx.Output, "Unblocked: %s\n", t.Info().Name)
+		}
+	}
+	return nil
+}
+
+// reportCompleted reports that the Task was completed, either as a
+// Record, or by name if verbose is set.
+func (ctx *Context) reportCompleted(t Task, verbose bool) {
+	if ctx.Structured() {
+		completed := ctx.Now()
+		ctx.emitTask(EventCompleted, t).Completed = &completed
+	} else if verbose {
+		fmt.Fprintf(ctx.Output, "Completed: %s\n", t.Info().Name)
+	}
+}
+
+// openBlockers returns the tasks blocking the given one, other than
+// those which have been completed.
+func openBlockers(t Task, completed map[Task]bool) (open []Task) {
+	for _, b := range t.Metadata().blockers {
+		if !completed[b] {
+			open = append(open, b)
+		}
+	}
+	return
+}
+
+func (c *Command) CmdShow(ctx *Context) (err error) {
+	glog.V(2).Infoln("User invoked show")
+
+	task, err := ctx.List.Find(strings.Join(c.Args, " "))
+	if err != nil {
+		return err
+	}
+
+	if ctx.Structured() {
+		ctx.emitTask(EventShown, task)
+		return nil
+	}
+
+	info := task.Info()
+	_, err = fmt.Fprintf(ctx.Output, "%4s %s\tID: %s\n", info.Alias,
+		task.LongString(), info.ID)
+	return err
+}
+
+func (c *Command) CmdArchive(ctx *Context) (err error) {
+	glog.V(2).Infoln("User invoked archive")
+
+	// Re-combine the arguments into a single string to search for.
+	// Every task matches the empty string.
+	searchterm := strings.Join(c.Args, " ")
+
+	// List the most recently completed tasks first, up to the same
+	// maximum as the list command.
+	n := ctx.MaxListItems
+	for i := len(ctx.fileList.Archive) - 1; i >= 0 && n != 0; i-- {
+		a := ctx.fileList.Archive[i]
+		if a.Contains(searchterm) {
+			io.WriteString(ctx.Output, a.String())
+			n--
+		}
+	}
+	return nil
+}
+
+func (c *Command) CmdReopen(ctx *Context) (err error) {
+	glog.V(2).Infoln("User invoked reopen")
+
+	a, err := ctx.fileList.FindArchived(strings.Join(c.Args, " "))
+	if err != nil {
+		return err
+	}
+	ctx.fileList.Reopen(a)
+	ctx.modified = true
+	return nil
+}
+
+func (c *Command) CmdRestore(ctx *Context) (err error) {
+	glog.V(2).Infoln("User invoked restore")
+
+	backups, err := ListBackups(ctx.loadpath)
+	if err != nil {
+		return err
+	}
+	if len(backups) == 0 {
+		return ErrNoBackups
+	}
+
+	// If no backup is given, list the ones that are available.
+	if len(c.Args) == 0 {
+		for _, b := range backups {
+			io.WriteString(ctx.Output, describeBackup(b))
 		}
+		return nil
+	}
+
+	generation, err := strconv.Atoi(c.Args[0])
+	if err != nil {
+		return ErrUnknownBackup
+	}
+	for _, b := range backups {
+		if b.Generation != generation {
+			continue
+		}
+
+		// Replace the list in memory and mark it as modified, so that
+		// it is written back when saving. Because saving rotates the
+		// backups, the list being replaced is itself kept.
+		fl, _, err := ReadListFile(b.Path)
+		if err != nil {
+			return err
+		}
+		ctx.fileList = fl
+		ctx.modified = true
+
+		fmt.Fprintf(ctx.Output, "Restored list from backup %d (%s)\n",
+			b.Generation, b.ModTime.Format(FullFormat))
+		return nil
+	}
+	return ErrUnknownBackup
+}
+
+func (c *Command) CmdUndo(ctx *Context) (err error) {
+	glog.V(2).Infoln("User invoked undo")
+	return c.walkJournal(ctx, (*Journal).Undo, "Undid")
+}
+
+func (c *Command) CmdRedo(ctx *Context) (err error) {
+	glog.V(2).Infoln("User invoked redo")
+	return c.walkJournal(ctx, (*Journal).Redo, "Redid")
+}
+
+// walkJournal implements undo and redo, by calling step on the
+// Context's journal as many times as the first argument requests, or
+// once if none is given.
+func (c *Command) walkJournal(ctx *Context,
+	step func(*Journal, *fileList) (*JournalEntry, error),
+	verb string) (err error) {
+
+	// The journal is updated directly, rather than recording this as
+	// a change of its own.
+	ctx.skipJournal = true
+
+	count := 1
+	if len(c.Args) > 0 {
+		count, err = strconv.Atoi(c.Args[0])
+		if err != nil || count < 1 {
+			return errors.New("invalid count")
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		entry, err := step(ctx.journal, &ctx.fileList)
+		if err != nil {
+			return err
+		}
+		ctx.modified = true
+		ctx.journalModified = true
+
+		fmt.Fprintf(ctx.Output, "%s: %s (%s)\n", verb, entry.Command,
+			entry.Time.Format(FullFormat))
 	}
 	return nil
 }
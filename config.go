@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config holds the settings read from the configuration file, by
+// name. Names are lower case, and may be nested by separating them
+// with dots, as in "urgency.due.coefficient".
+type Config map[string]string
+
+// ReadConfig parses settings from the given io.Reader, one per line,
+// in the form "name = value". Blank lines and those beginning with "#"
+// are ignored. If a line cannot be parsed, an empty Config is returned
+// along with the error, so that the defaults are used.
+func ReadConfig(r io.Reader) (Config, error) {
+	c := make(Config)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return Config{}, fmt.Errorf("line %d: expected name = value", n)
+		}
+		name := strings.ToLower(strings.TrimSpace(line[:i]))
+		c[name] = strings.TrimSpace(line[i+1:])
+	}
+	return c, scanner.Err()
+}
+
+// ReadConfigFile wraps ReadConfig. If the file does not exist, an
+// empty Config is returned.
+func ReadConfigFile(path string) (Config, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		glog.V(1).Infof("Config file %q doesn't exist, using defaults\n",
+			path)
+		return Config{}, nil
+	} else if err != nil {
+		return Config{}, err
+	}
+	defer f.Close()
+
+	return ReadConfig(f)
+}
+
+// String returns the named setting, or def if it is not set.
+func (c Config) String(name, def string) string {
+	if value, ok := c[name]; ok {
+		return value
+	}
+	return def
+}
+
+// Float returns the named setting as a number, or def if it is not
+// set.
+func (c Config) Float(name string, def float64) (float64, error) {
+	value, ok := c[name]
+	if !ok {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return def, fmt.Errorf("invalid number for %s: %q", name, value)
+	}
+	return f, nil
+}
+
+// Prefixed returns the names of the settings which begin with the
+// given prefix and end with the given suffix, with both removed.
+func (c Config) Prefixed(prefix, suffix string) (names []string) {
+	for name := range c {
+		if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix) &&
+			len(name) > len(prefix)+len(suffix) {
+			names = append(names, name[len(prefix):len(name)-len(suffix)])
+		}
+	}
+	return
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// EndOfDayHour is the hour of the day used for dates which are
+	// given without a time, such as "tomorrow". It is the end of the
+	// working day.
+	EndOfDayHour = 17
+)
+
+var (
+	ErrInvalidDate = errors.New("could not understand date")
+	ErrNoDate      = errors.New("no date given")
+)
+
+var (
+	// isoFormats are the ISO 8601 formats which are understood, with
+	// the portion of the date they specify.
+	isoFormats = []struct {
+		layout  string
+		hasTime bool
+	}{
+		{time.RFC3339, true},
+		{"2006-01-02T15:04:05", true},
+		{"2006-01-02T15:04", true},
+		{"2006-01-02", false},
+	}
+
+	// clockFormats are the formats in which a bare time of day is
+	// understood.
+	clockFormats = []string{"15:04", "3pm", "3:04pm"}
+
+	weekdays = map[string]time.Weekday{
+		"sun": time.Sunday, "sunday": time.Sunday,
+		"mon": time.Monday, "monday": time.Monday,
+		"tue": time.Tuesday, "tuesday": time.Tuesday,
+		"wed": time.Wednesday, "wednesday": time.Wednesday,
+		"thu": time.Thursday, "thursday": time.Thursday,
+		"fri": time.Friday, "friday": time.Friday,
+		"sat": time.Saturday, "saturday": time.Saturday,
+	}
+
+	months = map[string]time.Month{
+		"jan": time.January, "january": time.January,
+		"feb": time.February, "february": time.February,
+		"mar": time.March, "march": time.March,
+		"apr": time.April, "april": time.April,
+		"may": time.May,
+		"jun": time.June, "june": time.June,
+		"jul": time.July, "july": time.July,
+		"aug": time.August, "august": time.August,
+		"sep": time.September, "september": time.September,
+		"oct": time.October, "october": time.October,
+		"nov": time.November, "november": time.November,
+		"dec": time.December, "december": time.December,
+	}
+)
+
+// dateSpec accumulates the parts of a date as they are parsed. A date
+// may be given as an absolute day, a time of day, or both, or as an
+// exact offset from the present.
+type dateSpec struct {
+	now time.Time
+
+	day    time.Time
+	hasDay bool
+
+	hour, min int
+	hasClock  bool
+
+	// exact is set when the date is an offset of hours or minutes,
+	// which needs no time of day.
+	exact    time.Time
+	hasExact bool
+
+	// recur is set when the day was given in a way that implies the
+	// next occurrence of it, such as a weekday name, so that it can be
+	// moved forward if the result is in the past.
+	recur recurrence
+}
+
+// recurrence is the period after which a date given without a year or
+// week occurs again.
+type recurrence int
+
+const (
+	noRecurrence recurrence = iota
+	weekly
+	yearly
+)
+
+// ParseDate interprets a human-friendly date relative to now. It
+// understands:
+//
+//	today, tonight, tomorrow, yesterday
+//	mon, friday, next monday
+//	+3d, +2w, in 2 weeks, in 4 hours (units: min, h, d, w, mo, y)
+//	eod, eow, eom, eoy (end of day, working week, month, year)
+//	2006-01-02, 2006-01-02T15:04, RFC 3339
+//	Jan 2, January 2 2006
+//	15:04, 9am, 9:30pm, noon, midnight
+//
+// along with combinations of a day and a time, such as "tomorrow 9am"
+// or "2006-01-02 15:04". If only a time is given, it is the next
+// occurrence of that time. If only a day is given, the time is the end
+// of the working day, EndOfDayHour.
+func ParseDate(s string, now time.Time) (time.Time, error) {
+	words := strings.Fields(strings.ToLower(s))
+	if len(words) == 0 {
+		return time.Time{}, ErrNoDate
+	}
+
+	spec := &dateSpec{now: now}
+	for i := 0; i < len(words); i++ {
+		consumed, err := spec.parse(words[i:])
+		if err != nil {
+			return time.Time{}, err
+		}
+		i += consumed - 1
+	}
+	return spec.result(), nil
+}
+
+// ParseDateRange interprets words as a start date, optionally followed
+// by an end date. The two may be separated by "until" or "to", but if
+// they are not, then the words are split at the first point where both
+// halves are valid dates. If all the words form a single date, it is
+// the start, and the end is zero.
+func ParseDateRange(words []string, now time.Time) (start, end time.Time,
+	err error) {
+
+	if len(words) == 0 {
+		return start, end, ErrNoDate
+	}
+
+	for i, word := range words {
+		if word == "until" || word == "to" {
+			start, err = ParseDate(strings.Join(words[:i], " "), now)
+			if err != nil {
+				return
+			}
+			end, err = ParseDate(strings.Join(words[i+1:], " "), now)
+			return
+		}
+	}
+
+	if start, err = ParseDate(strings.Join(words, " "), now); err == nil {
+		return
+	}
+	for i := 1; i < len(words); i++ {
+		start, err = ParseDate(strings.Join(words[:i], " "), now)
+		if err != nil {
+			continue
+		}
+		end, err = ParseDate(strings.Join(words[i:], " "), now)
+		if err == nil {
+			return
+		}
+	}
+	return time.Time{}, time.Time{}, ErrInvalidDate
+}
+
+// parse interprets the first of the given words, along with any that
+// follow it which it needs, and returns the number of words used.
+func (spec *dateSpec) parse(words []string) (int, error) {
+	word := words[0]
+	now := spec.now
+	today := midnight(now)
+
+	switch word {
+	case "today", "eod":
+		return 1, spec.setDay(today, noRecurrence)
+	case "tonight":
+		spec.setClock(21, 0)
+		return 1, spec.setDay(today, noRecurrence)
+	case "tomorrow":
+		return 1, spec.setDay(today.AddDate(0, 0, 1), noRecurrence)
+	case "yesterday":
+		return 1, spec.setDay(today.AddDate(0, 0, -1), noRecurrence)
+	case "eow":
+		return 1, spec.setDay(nextWeekday(today, time.Friday, false),
+			noRecurrence)
+	case "eom":
+		return 1, spec.setDay(
+			time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0,
+				now.Location()), noRecurrence)
+	case "eoy":
+		return 1, spec.setDay(
+			time.Date(now.Year(), time.December, 31, 0, 0, 0, 0,
+				now.Location()), noRecurrence)
+	case "noon":
+		return 1, spec.setClock(12, 0)
+	case "midnight":
+		return 1, spec.setClock(0, 0)
+
+	case "next":
+		if len(words) < 2 {
+			return 1, ErrInvalidDate
+		}
+		if wd, ok := weekdays[words[1]]; ok {
+			return 2, spec.setDay(nextWeekday(today, wd, true),
+				noRecurrence)
+		}
+		if offset, ok := parseOffset("1", words[1]); ok {
+			return 2, spec.addOffset(offset)
+		}
+		return 2, ErrInvalidDate
+
+	case "in":
+		if len(words) < 3 {
+			return 1, ErrInvalidDate
+		}
+		if offset, ok := parseOffset(words[1], words[2]); ok {
+			return 3, spec.addOffset(offset)
+		}
+		return 3, ErrInvalidDate
+	}
+
+	// Weekday names refer to the next such day, including today.
+	if wd, ok := weekdays[word]; ok {
+		return 1, spec.setDay(nextWeekday(today, wd, false), weekly)
+	}
+
+	// Month names are followed by a day of the month, and optionally a
+	// year. Without a year, they refer to the next such date.
+	if month, ok := months[word]; ok {
+		if len(words) < 2 {
+			return 1, ErrInvalidDate
+		}
+		day, err := strconv.Atoi(strings.TrimSuffix(words[1], ","))
+		if err != nil {
+			return 2, ErrInvalidDate
+		}
+		if len(words) > 2 {
+			if year, err := strconv.Atoi(words[2]); err == nil &&
+				year > 999 {
+				return 3, spec.setDay(time.Date(year, month, day, 0, 0,
+					0, 0, now.Location()), noRecurrence)
+			}
+		}
+		date := time.Date(now.Year(), month, day, 0, 0, 0, 0,
+			now.Location())
+		return 2, spec.setDay(date, yearly)
+	}
+
+	// Relative offsets in the form +3d.
+	if strings.HasPrefix(word, "+") {
+		amount := strings.TrimLeft(word[1:], "0123456789")
+		if offset, ok := parseOffset(word[1:len(word)-len(amount)],
+			amount); ok {
+			return 1, spec.addOffset(offset)
+		}
+		return 1, ErrInvalidDate
+	}
+
+	for _, format := range isoFormats {
+		t, err := time.ParseInLocation(format.layout,
+			strings.ToUpper(word), now.Location())
+		if err != nil {
+			continue
+		}
+		if format.hasTime {
+			spec.setClock(t.Hour(), t.Minute())
+		}
+		return 1, spec.setDay(midnight(t), noRecurrence)
+	}
+
+	for _, format := range clockFormats {
+		t, err := time.Parse(format, word)
+		if err == nil {
+			return 1, spec.setClock(t.Hour(), t.Minute())
+		}
+	}
+
+	return 1, ErrInvalidDate
+}
+
+// offset is a relative date, either in calendar units or as an exact
+// duration.
+type offset struct {
+	years, months, days int
+	exact               time.Duration
+}
+
+// parseOffset interprets an amount and a unit, such as "3" and "days"
+// or "d".
+func parseOffset(amount, unit string) (o offset, ok bool) {
+	n, err := strconv.Atoi(amount)
+	if err != nil {
+		return o, false
+	}
+
+	switch strings.TrimSuffix(unit, "s") {
+	case "min", "minute":
+		o.exact = time.Duration(n) * time.Minute
+	case "h", "hr", "hour":
+		o.exact = time.Duration(n) * time.Hour
+	case "d", "day":
+		o.days = n
+	case "w", "wk", "week":
+		o.days = 7 * n
+	case "mo", "month":
+		o.months = n
+	case "y", "yr", "year":
+		o.years = n
+	default:
+		return o, false
+	}
+	return o, true
+}
+
+// addOffset applies an offset relative to the present.
+func (spec *dateSpec) addOffset(o offset) error {
+	if o.exact != 0 {
+		if spec.hasExact || spec.hasDay {
+			return ErrInvalidDate
+		}
+		spec.exact, spec.hasExact = spec.now.Add(o.exact), true
+		return nil
+	}
+	return spec.setDay(midnight(spec.now).AddDate(o.years, o.months,
+		o.days), noRecurrence)
+}
+
+// setDay sets the day of the date, which must not have been set
+// already. If the day recurs, it is moved forward by a week or year if
+// the date would otherwise be in the past.
+func (spec *dateSpec) setDay(day time.Time, recur recurrence) error {
+	if spec.hasDay || spec.hasExact {
+		return ErrInvalidDate
+	}
+	spec.day, spec.hasDay, spec.recur = day, true, recur
+	return nil
+}
+
+// setClock sets the time of day of the date.
+func (spec *dateSpec) setClock(hour, min int) error {
+	if spec.hasClock || spec.hasExact {
+		return ErrInvalidDate
+	}
+	spec.hour, spec.min, spec.hasClock = hour, min, true
+	return nil
+}
+
+// result combines the parts of the date, filling in those which were
+// omitted.
+func (spec *dateSpec) result() time.Time {
+	if spec.hasExact {
+		return spec.exact
+	}
+
+	day := spec.day
+	if !spec.hasDay {
+		day = midnight(spec.now)
+	}
+	hour, min := EndOfDayHour, 0
+	if spec.hasClock {
+		hour, min = spec.hour, spec.min
+	}
+
+	t := time.Date(day.Year(), day.Month(), day.Day(), hour, min, 0, 0,
+		day.Location())
+
+	// A bare time refers to its next occurrence, as do dates which
+	// were given without a year or week.
+	switch {
+	case !t.Before(spec.now):
+	case !spec.hasDay:
+		t = t.AddDate(0, 0, 1)
+	case spec.recur == weekly:
+		t = t.AddDate(0, 0, 7)
+	case spec.recur == yearly:
+		t = t.AddDate(1, 0, 0)
+	}
+	return t
+}
+
+// midnight returns the start of the day containing t.
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// nextWeekday returns the next day from today which falls on the
+// given weekday. If today is that weekday, then today is returned,
+// unless strict is set, in which case the same day next week is.
+func nextWeekday(today time.Time, wd time.Weekday, strict bool) time.Time {
+	days := (int(wd) - int(today.Weekday()) + 7) % 7
+	if days == 0 && strict {
+		days = 7
+	}
+	return today.AddDate(0, 0, days)
+}
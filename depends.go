@@ -0,0 +1,219 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// ResolveDepends finds the tasks identified by the given search terms,
+// as with Find, and returns their IDs. The alias of a recurring task
+// identifies the recurring task itself, rather than one instance of
+// it.
+func (l List) ResolveDepends(terms []string) (ids []string, err error) {
+	for _, term := range terms {
+		t, err := l.Find(term)
+		if amb, ok := err.(*AmbiguousError); ok {
+			// Instances of the same recurring task stand for it.
+			if tasks := l.sameContainer(amb); tasks != nil {
+				t, err = tasks[0], nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		id := t.Info().ID
+		if r, ok := t.(*RecurringTask); ok && !t.Info().MatchesID(term) {
+			id = r.parent.ID
+		}
+		ids = append(ids, id)
+	}
+	return
+}
+
+// removeDepends removes the given IDs from the tasks depended on.
+func (m *Meta) removeDepends(ids ...string) {
+	depends := m.Depends[:0]
+	for _, dep := range m.Depends {
+		keep := true
+		for _, id := range ids {
+			keep = keep && dep != id
+		}
+		if keep {
+			depends = append(depends, dep)
+		}
+	}
+	m.Depends = depends
+	if len(m.Depends) == 0 {
+		m.Depends = nil
+	}
+}
+
+// blockerAliases formats the aliases of the given tasks as a comma
+// separated list.
+func blockerAliases(blockers []Task) string {
+	aliases := make([]string, len(blockers))
+	for i, b := range blockers {
+		aliases[i] = b.Info().Alias
+	}
+	return strings.Join(aliases, ",")
+}
+
+// findBlockers finds the tasks in the List which block each other.
+func (l List) findBlockers() {
+	// Index the tasks by their IDs, and those of their recurring
+	// tasks, so that dependencies on either can be found.
+	index := make(map[string][]Task, len(l))
+	for _, t := range l {
+		t.Metadata().blockers = nil
+		t.Metadata().dependents = nil
+
+		id := t.Info().ID
+		index[id] = append(index[id], t)
+		if r, ok := t.(*RecurringTask); ok {
+			index[r.parent.ID] = append(index[r.parent.ID], t)
+		}
+	}
+
+	for _, t := range l {
+		m := t.Metadata()
+		for _, id := range m.Depends {
+			for _, b := range index[id] {
+				if containerOf(b) != containerOf(t) {
+					m.blockers = append(m.blockers, b)
+					b.Metadata().dependents = append(
+						b.Metadata().dependents, t)
+				}
+			}
+		}
+	}
+}
+
+// rankDependencies re-sorts the List so that blocked tasks come after
+// the tasks in it which block them, as found by findBlockers. A
+// blocking task takes on the urgency of the most urgent task it
+// blocks, so that it is listed no later than that task would be. The
+// List is assumed to be sorted by Nice already.
+func (l List) rankDependencies() {
+	pos := make(map[Task]int, len(l))
+	for i, t := range l {
+		pos[t] = i
+	}
+
+	blocked := false
+	for _, t := range l {
+		for _, b := range t.Metadata().blockers {
+			_, listed := pos[b]
+			blocked = blocked || listed
+		}
+	}
+	if !blocked {
+		return
+	}
+
+	// Pass the urgency of each blocked task down to its blockers, and
+	// count how deeply each task is blocked, until neither changes.
+	// Dependency cycles would otherwise never settle, so there are at
+	// most as many rounds as tasks.
+	r := rankedList{
+		List:  l,
+		nice:  make([]int, len(l)),
+		depth: make([]int, len(l)),
+	}
+	for i, t := range l {
+		r.nice[i] = t.Nice()
+	}
+	for round := 0; round < len(l); round++ {
+		changed := false
+		for i, t := range l {
+			for _, b := range t.Metadata().blockers {
+				j, listed := pos[b]
+				if !listed {
+					continue
+				}
+				if r.nice[i] < r.nice[j] {
+					r.nice[j] = r.nice[i]
+					changed = true
+				}
+				if r.depth[i] <= r.depth[j] {
+					r.depth[i] = r.depth[j] + 1
+					changed = true
+				}
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	sort.Stable(r)
+}
+
+// rankedList sorts a List by nice values and depths which have been
+// calculated in advance, such as by rankDependencies.
+type rankedList struct {
+	List
+	nice, depth []int
+}
+
+// Less orders tasks by their nice values, and then blocking tasks
+// before the tasks they block. (For use with package sort.)
+func (r rankedList) Less(i, j int) bool {
+	if r.nice[i] != r.nice[j] {
+		return r.nice[i] < r.nice[j]
+	}
+	return r.depth[i] < r.depth[j]
+}
+
+// Swap swaps both the tasks and their calculated values. (For use with
+// package sort.)
+func (r rankedList) Swap(i, j int) {
+	r.List.Swap(i, j)
+	r.nice[i], r.nice[j] = r.nice[j], r.nice[i]
+	r.depth[i], r.depth[j] = r.depth[j], r.depth[i]
+}
+
+// dependencyCycle returns the tasks blocking the given one which in
+// turn are blocked by it, in order, starting with the task itself, or
+// nil if there are none.
+func dependencyCycle(t Task) []Task {
+	visited := make(map[Task]bool)
+	var visit func(path []Task) []Task
+	visit = func(path []Task) []Task {
+		for _, b := range path[len(path)-1].Metadata().blockers {
+			if b == t {
+				return path
+			}
+			if !visited[b] {
+				visited[b] = true
+				if cycle := visit(append(path, b)); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		return nil
+	}
+	return visit([]Task{t})
+}
+
+// formatCycle describes a dependency cycle, such as "3 -> 5 -> 3".
+func formatCycle(cycle []Task) string {
+	aliases := make([]string, 0, len(cycle)+1)
+	for _, t := range append(cycle, cycle[0]) {
+		aliases = append(aliases, t.Info().Alias)
+	}
+	return strings.Join(aliases, " -> ")
+}
+
+// unblock removes the completed task from the dependencies of the
+// tasks remaining in the fileList. Dependencies on a recurring task
+// are only removed once it has no more instances.
+func (fl *fileList) unblock(t Task) {
+	ids := []string{t.Info().ID}
+	if r, ok := t.(*RecurringTask); ok && !fl.Contains(r.parent) {
+		ids = append(ids, r.parent.ID)
+	}
+
+	fl.walk(func(c, _ TaskContainer) {
+		metaOf(c).removeDepends(ids...)
+	})
+}
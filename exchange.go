@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultPriority is the priority given to imported tasks which
+	// have none.
+	DefaultPriority = 5
+)
+
+var (
+	ErrMissingFormat = errors.New("no format given")
+	ErrMissingFile   = errors.New("no file given")
+	ErrTooManyFiles  = errors.New("more than one file given")
+)
+
+// Exporter writes the tasks of the Context to an io.Writer in some
+// other format.
+type Exporter func(ctx *Context, w io.Writer) error
+
+// Exporters are the formats which tasks may be exported to, by name.
+var Exporters = map[string]Exporter{
+	"ical":        ExportICal,
+	"taskwarrior": ExportTaskwarrior,
+	"todotxt":     ExportTodoTxt,
+}
+
+// Imported describes the changes made by an Importer.
+type Imported struct {
+	// Added are the tasks which were added.
+	Added []TaskContainer
+
+	// Updated and Completed count the tasks which already existed,
+	// and were changed or completed.
+	Updated, Completed int
+}
+
+// Importer reads tasks in some other format from an io.Reader into the
+// Context, updating those which were imported before.
+type Importer func(ctx *Context, r io.Reader) (Imported, error)
+
+// Importers are the formats which tasks may be imported from, by name.
+var Importers = map[string]Importer{
+	"ical":        ImportICal,
+	"taskwarrior": ImportTaskwarrior,
+	"todotxt":     ImportTodoTxt,
+}
+
+// formatNames lists the names of the formats, for error messages.
+func formatNames(names []string) string {
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func (c *Command) CmdExport(ctx *Context) (err error) {
+	glog.V(2).Infoln("User invoked export")
+
+	// The syntax is "export format [file] [filter]", where the filter
+	// terms may be given anywhere. Without a file, the tasks are
+	// written to the output.
+	filter, args, err := ParseFilter(c.Args, ctx.Now())
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(args) == 0:
+		return ErrMissingFormat
+	case len(args) > 2:
+		return ErrTooManyFiles
+	}
+	export, ok := Exporters[strings.ToLower(args[0])]
+	if !ok {
+		var names []string
+		for name := range Exporters {
+			names = append(names, name)
+		}
+		return fmt.Errorf("unknown format %q, expected one of %s",
+			args[0], formatNames(names))
+	}
+
+	// Only the matching tasks are exported, by giving the exporter a
+	// list holding only them, and putting the whole list back after.
+	if !filter.Empty() {
+		matching, err := ctx.fileList.filtered(ctx.List.Filter(filter))
+		if err != nil {
+			return err
+		}
+		all := ctx.fileList
+		ctx.fileList = *matching
+		defer func() { ctx.fileList = all }()
+	}
+
+	if len(args) == 1 {
+		return export(ctx, ctx.Output)
+	}
+	f, err := os.Create(os.ExpandEnv(args[1]))
+	if err != nil {
+		return err
+	}
+	if err = export(ctx, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (c *Command) CmdImport(ctx *Context) (err error) {
+	glog.V(2).Infoln("User invoked import")
+
+	// The syntax is "import format file".
+	if len(c.Args) == 0 {
+		return ErrMissingFormat
+	} else if len(c.Args) != 2 {
+		return ErrMissingFile
+	}
+	importer, ok := Importers[strings.ToLower(c.Args[0])]
+	if !ok {
+		var names []string
+		for name := range Importers {
+			names = append(names, name)
+		}
+		return fmt.Errorf("unknown format %q, expected one of %s",
+			c.Args[0], formatNames(names))
+	}
+
+	f, err := os.Open(os.ExpandEnv(c.Args[1]))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	result, err := importer(ctx, f)
+	if err != nil {
+		return err
+	}
+	if len(result.Added) > 0 || result.Updated > 0 || result.Completed > 0 {
+		ctx.modified = true
+	}
+
+	if ctx.Structured() {
+		for _, added := range result.Added {
+			ctx.emitAdded(added)
+		}
+		return nil
+	}
+	fmt.Fprintf(ctx.Output, "Added %d, updated %d, and completed %d tasks\n",
+		len(result.Added), result.Updated, result.Completed)
+	return nil
+}
+
+// filtered gives a copy of the fileList holding only the containers of
+// the given tasks, without the archive. Subtasks stay beneath their
+// tasks if those are held as well, and otherwise take their place.
+func (fl *fileList) filtered(tasks List) (*fileList, error) {
+	keep := make(map[TaskContainer]bool)
+	for _, t := range tasks {
+		keep[containerOf(t)] = true
+	}
+
+	var visit func(from, into *fileList) error
+	visit = func(from, into *fileList) error {
+		for _, c := range from.containers() {
+			if !keep[c] {
+				if err := visit(c.Children(), into); err != nil {
+					return err
+				}
+				continue
+			}
+
+			b, err := json.Marshal(c)
+			if err != nil {
+				return err
+			}
+			copied, err := decodeContainer(b, c)
+			if err != nil {
+				return err
+			}
+			children := &fileList{}
+			if err = visit(c.Children(), children); err != nil {
+				return err
+			}
+			if children.Empty() {
+				children = nil
+			}
+			copied.SetChildren(children)
+			into.add(copied)
+		}
+		return nil
+	}
+
+	matching := &fileList{}
+	return matching, visit(fl, matching)
+}
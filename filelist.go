@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"github.com/golang/glog"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"unicode"
 )
 
 // fileList is the structure wrapping task lists to be stored on-disk.
@@ -13,26 +17,69 @@ type fileList struct {
 	Definite  []*DefiniteTask
 	Eventual  []*EventualTask
 	Recurring []*RecurringTaskGenerator
+
+	// Archive holds records of completed tasks, in the order they
+	// were completed.
+	Archive []*ArchivedTask `json:",omitempty"`
+
+	// unread holds the lines of a todo.txt list which could not be
+	// read as tasks, so that they are written back as they were.
+	unread []unreadLine
 }
 
 var (
 	UnknownTaskType = errors.New("Task type unknown to file list encoder")
+
+	ErrListNotJSON = errors.New("list file is not JSON; name it " +
+		"with a " + TodoTxtExt + " extension to keep it in the todo.txt format")
+	ErrListNotTodoTxt = errors.New("list file is JSON, but its name " +
+		"ends in " + TodoTxtExt)
 )
 
-// ReadList decodes a JSON-encoded fileList from the given io.Reader,
-// converts it to a List, then sorts and returns it.
-func ReadList(r io.Reader) (fl fileList, err error) {
-	err = json.NewDecoder(r).Decode(&fl)
+// ReadList decodes a fileList from the given io.Reader, with
+// ReadTodoTxt if todoTxt is true, and as JSON otherwise. A list in the
+// other format is refused, rather than being read in one format and
+// written back in the other the next time it is saved. An empty list
+// may be in either.
+func ReadList(r io.Reader, todoTxt bool) (fl fileList, err error) {
+	br := bufio.NewReader(r)
+	first, ok := firstNonSpace(br)
+	switch {
+	case !ok:
+		return fl, nil
+	case todoTxt && first == '{':
+		return fl, ErrListNotTodoTxt
+	case !todoTxt && first != '{':
+		return fl, ErrListNotJSON
+	case todoTxt:
+		return ReadTodoTxt(br)
+	}
+	err = json.NewDecoder(br).Decode(&fl)
 	return fl, err
 }
 
+// firstNonSpace gives the first character after any whitespace,
+// without consuming it, or false if there is none.
+func firstNonSpace(br *bufio.Reader) (byte, bool) {
+	for n := 1; ; n++ {
+		b, err := br.Peek(n)
+		if err != nil {
+			return 0, false
+		}
+		if c := b[n-1]; !unicode.IsSpace(rune(c)) {
+			return c, true
+		}
+	}
+}
+
 // Write JSON-encodes the fileList to the given io.Writer.
 func (fl fileList) Write(w io.Writer) error {
 	return json.NewEncoder(w).Encode(fl)
 }
 
-// ReadListFile wraps ReadList and returns a fileList. If the file
-// given does not exist, then isNew will be true.
+// ReadListFile wraps ReadList and returns a fileList, which is in the
+// todo.txt format if IsTodoTxt says so of the path. If the file given
+// does not exist, then isNew will be true.
 func ReadListFile(path string) (fl fileList, isNew bool, err error) {
 	// Try to read the file. If the error is that the file doesn't
 	// exist, return an empty list, or otherwise return an error.
@@ -45,38 +92,83 @@ func ReadListFile(path string) (fl fileList, isNew bool, err error) {
 	}
 	defer f.Close()
 
-	fl, err = ReadList(f)
+	fl, err = ReadList(f, IsTodoTxt(path))
 	return fl, false, err
 }
 
-// WriteFile wraps Write to encode the fileList to a file.
+// WriteFile wraps Write to encode the fileList to a file, or
+// WriteTodoTxt if the file is kept in the todo.txt format. It is
+// written atomically, so that the file at path is never left
+// partially written.
 func (fl fileList) WriteFile(path string) error {
-	f, err := os.Create(path)
+	if IsTodoTxt(path) {
+		return writeFileAtomic(path, fl.WriteTodoTxt)
+	}
+	return writeFileAtomic(path, fl.Write)
+}
+
+// writeFileAtomic calls write to fill a temporary file in the same
+// directory as path, syncs it to disk, and then renames it over the
+// file at path.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(path),
+		"."+filepath.Base(path)+".tmp")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	tmppath := f.Name()
 
-	return fl.Write(f)
-}
+	// If anything goes wrong before the rename, remove the temporary
+	// file so that it doesn't litter the directory.
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
 
-// List converts a fileList to a List, sorts it, and returns it.
-func (fl fileList) List() (l List) {
-	// Find the length, roughly, and make a List with that capacity.
-	length := len(fl.Definite) + len(fl.Eventual)
-	l = make(List, 0, length)
+	// Preserve the permissions of the original file, if there is one,
+	// because TempFile creates files readable only by the owner.
+	if info, err := os.Stat(path); err == nil {
+		os.Chmod(tmppath, info.Mode().Perm())
+	}
 
-	// Loop through each field and append
-	for _, t := range fl.Definite {
-		l = append(l, t.Tasks()...)
+	if err = os.Rename(tmppath, path); err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+
+	// Sync the directory, so that the rename itself is durable. Not
+	// all systems support this, so failure is not an error.
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
 	}
-	for _, t := range fl.Eventual {
-		l = append(l, t.Tasks()...)
+	return nil
+}
+
+// List converts a fileList to a List, sorts it, and returns it. Tasks
+// which are blocked by others are sorted after them. Subtasks follow
+// the task they belong to, sorted among themselves.
+func (fl fileList) List() (l List) {
+	b := &listBuilder{
+		subtasks:  make(map[Task]List),
+		completed: make(map[string]int),
 	}
-	for _, t := range fl.Recurring {
-		l = append(l, t.Tasks()...)
+	for _, a := range fl.Archive {
+		if a.Parent != "" {
+			b.completed[a.Parent]++
+		}
 	}
 
-	l.Sort()
-	return l
+	// Produce every task before sorting any, so that dependencies
+	// between tasks at any depth can be found.
+	l = b.tasks(&fl, 0)
+	b.all.findBlockers()
+	return b.nest(l)
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// priorityTerm matches filter terms such as "priority<3", and
+	// dueTerm those such as "due.before:fri".
+	priorityTerm = regexp.MustCompile(`^(?:priority|pri)(<=|>=|<|>|:)(-?\d+)$`)
+	dueTerm      = regexp.MustCompile(`^due(\.before|\.after)?:(.+)$`)
+
+	// matchTerm matches filter terms such as "name~regex".
+	matchTerm = regexp.MustCompile(`^(name|desc|description)~(.*)$`)
+)
+
+// Filter is a predicate over Tasks, made up of terms which must all be
+// satisfied. It is parsed from arguments such as
+//
+//	+tag -tag project:name type:recurring overdue blocked unblocked
+//	priority<3 priority>=2 priority:1
+//	due:fri due.before:fri due.after:tomorrow
+//	name~regex desc~regex
+//
+// where dates are anything understood by ParseDate. The empty Filter
+// matches every Task.
+type Filter struct {
+	terms []func(Task) bool
+
+	// blocked is set if the Filter asks for blocked tasks, which may
+	// otherwise be hidden.
+	blocked bool
+}
+
+// ParseFilter separates the filter terms from the given arguments,
+// and returns a Filter made from them along with the remaining
+// arguments. Dates are interpreted relative to now.
+func ParseFilter(args []string, now time.Time) (f Filter, rest []string,
+	err error) {
+
+	for _, arg := range args {
+		term, err := parseTerm(arg, now)
+		if err != nil {
+			return f, nil, err
+		}
+		if term == nil {
+			rest = append(rest, arg)
+		} else {
+			f.terms = append(f.terms, term)
+			f.blocked = f.blocked || arg == "blocked"
+		}
+	}
+	return f, rest, nil
+}
+
+// parseTerm parses a single filter term. If the argument is not a
+// filter term, it returns nil and no error.
+func parseTerm(arg string, now time.Time) (func(Task) bool, error) {
+	if sign, tag, ok := tagArgument(arg); ok {
+		return func(t Task) bool {
+			return t.Metadata().HasTag(tag) == (sign == '+')
+		}, nil
+	}
+
+	if strings.HasPrefix(arg, ProjectPrefix) {
+		project := strings.TrimPrefix(arg, ProjectPrefix)
+		return func(t Task) bool {
+			return t.Metadata().InProject(project)
+		}, nil
+	}
+
+	if strings.HasPrefix(arg, "type:") {
+		kind := strings.ToLower(strings.TrimPrefix(arg, "type:"))
+		switch kind {
+		case TypeDefinite, TypeEventual, TypeRecurring:
+		default:
+			return nil, fmt.Errorf("unknown task type %q", kind)
+		}
+		return func(t Task) bool { return t.Info().Type == kind }, nil
+	}
+
+	if arg == "overdue" {
+		return func(t Task) bool {
+			due := t.Info().DueBy
+			return !due.IsZero() && due.Before(now)
+		}, nil
+	}
+
+	if arg == "blocked" || arg == "unblocked" {
+		blocked := arg == "blocked"
+		return func(t Task) bool {
+			return (len(t.Metadata().blockers) > 0) == blocked
+		}, nil
+	}
+
+	if m := priorityTerm.FindStringSubmatch(arg); m != nil {
+		n, _ := strconv.Atoi(m[2])
+		compare := map[string]func(int) bool{
+			"<":  func(p int) bool { return p < n },
+			"<=": func(p int) bool { return p <= n },
+			">":  func(p int) bool { return p > n },
+			">=": func(p int) bool { return p >= n },
+			":":  func(p int) bool { return p == n },
+		}[m[1]]
+		return func(t Task) bool { return compare(t.Info().Priority) }, nil
+	}
+
+	if m := dueTerm.FindStringSubmatch(arg); m != nil {
+		date, err := ParseDate(m[2], now)
+		if err != nil {
+			return nil, err
+		}
+		op := m[1]
+		return func(t Task) bool {
+			due := t.Info().DueBy
+			switch {
+			case due.IsZero():
+				return false
+			case op == ".before":
+				return due.Before(date)
+			case op == ".after":
+				return due.After(date)
+			}
+			return midnight(due).Equal(midnight(date))
+		}, nil
+	}
+
+	if m := matchTerm.FindStringSubmatch(arg); m != nil {
+		re, err := regexp.Compile("(?i)" + m[2])
+		if err != nil {
+			return nil, err
+		}
+		if m[1] == "name" {
+			return func(t Task) bool { return re.MatchString(t.Info().Name) },
+				nil
+		}
+		return func(t Task) bool {
+			return re.MatchString(t.Info().Description)
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// isFilterTerm checks whether the argument is a filter term, without
+// interpreting it.
+func isFilterTerm(arg string) bool {
+	term, err := parseTerm(arg, time.Time{})
+	return term != nil || err != nil
+}
+
+// Empty reports whether the Filter has no terms.
+func (f Filter) Empty() bool {
+	return len(f.terms) == 0
+}
+
+// Blocked reports whether the Filter asks for blocked tasks.
+func (f Filter) Blocked() bool {
+	return f.blocked
+}
+
+// Match checks whether the Task satisfies every term of the Filter.
+func (f Filter) Match(t Task) bool {
+	for _, term := range f.terms {
+		if !term(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// Filter returns the Tasks in the List which match the Filter, in the
+// same order.
+func (l List) Filter(f Filter) (matched List) {
+	for _, t := range l {
+		if f.Match(t) {
+			matched = append(matched, t)
+		}
+	}
+	return
+}
+
+// Select finds the tasks identified by the given arguments. If they
+// contain filter terms, then every task matching them is returned,
+// narrowed down to those with names starting with the remaining
+// arguments if there are any. Otherwise, the arguments must identify a
+// single task, as with Find.
+func (l List) Select(args []string, now time.Time) (List, error) {
+	f, rest, err := ParseFilter(args, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Empty() {
+		t, err := l.Find(strings.Join(rest, " "))
+		if err != nil {
+			return nil, err
+		}
+		return List{t}, nil
+	}
+
+	matched := l.Filter(f)
+	if len(rest) > 0 {
+		term := strings.Join(rest, " ")
+		var named List
+		for _, t := range matched {
+			if t.Match(term) {
+				named = append(named, t)
+			}
+		}
+		matched = named
+	}
+	if len(matched) == 0 {
+		return nil, ErrNoMatch
+	}
+	return matched, nil
+}
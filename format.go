@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// FormatText, FormatJSON, and FormatNDJSON name the output formats
+	// which may be selected with the -format flag. FormatJSON writes
+	// the Records produced by each command as a single JSON array, and
+	// FormatNDJSON writes each Record as a JSON object on its own line.
+	FormatText   = "text"
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+
+	// RecordSchema is the version of the Record schema. It is
+	// increased whenever fields are renamed or removed, or their
+	// meanings change, but not when fields are added.
+	RecordSchema = 1
+
+	// RecordTask, RecordWarning, and RecordError are the kinds of
+	// Record.
+	RecordTask    = "task"
+	RecordWarning = "warning"
+	RecordError   = "error"
+
+	// EventListed, EventShown, EventAdded, EventModified,
+	// EventCompleted, and EventUnblocked describe what happened to the
+	// task in a Record.
+	EventListed    = "listed"
+	EventShown     = "shown"
+	EventAdded     = "added"
+	EventModified  = "modified"
+	EventCompleted = "completed"
+	EventUnblocked = "unblocked"
+)
+
+// Record is a single structured object of output, written by commands
+// when the output format is FormatJSON or FormatNDJSON. Every Record
+// gives the version of the schema and its kind. Task records describe
+// the task and what happened to it, and warnings and errors give a
+// message.
+type Record struct {
+	Schema  int    `json:"schema"`
+	Kind    string `json:"kind"`
+	Event   string `json:"event,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	*TaskRecord
+}
+
+// TaskRecord describes a task in a Record. Due is left out for
+// eventual tasks, and Occurrence and Missed for all but recurring
+// tasks. Nice is the nice value by which tasks are sorted, as
+// calculated by the urgency model. Blockers are the aliases of the
+// listed tasks which the task depends on.
+type TaskRecord struct {
+	Type        string     `json:"type"`
+	ID          string     `json:"id"`
+	Alias       string     `json:"alias"`
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Priority    int        `json:"priority"`
+	Due         *time.Time `json:"due,omitempty"`
+	Nice        int        `json:"nice"`
+	Occurrence  int        `json:"occurrence,omitempty"`
+	Missed      int        `json:"missed,omitempty"`
+	Completed   *time.Time `json:"completed,omitempty"`
+
+	Project  string   `json:"project,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Depends  []string `json:"depends,omitempty"`
+	Blockers []string `json:"blockers,omitempty"`
+	Depth    int      `json:"depth,omitempty"`
+}
+
+// NewTaskRecord describes the given Task.
+func NewTaskRecord(t Task) *TaskRecord {
+	info := t.Info()
+	r := &TaskRecord{
+		Type:        info.Type,
+		ID:          info.ID,
+		Alias:       info.Alias,
+		Name:        info.Name,
+		Description: info.Description,
+		Priority:    info.Priority,
+		Nice:        t.Nice(),
+		Occurrence:  info.Occurrence,
+		Missed:      info.Missed,
+		Project:     info.Project,
+		Tags:        info.Tags,
+		Depends:     info.Depends,
+		Depth:       info.depth,
+	}
+	if !info.DueBy.IsZero() {
+		due := info.DueBy
+		r.Due = &due
+	}
+	for _, b := range info.blockers {
+		r.Blockers = append(r.Blockers, b.Info().Alias)
+	}
+	return r
+}
+
+// ParseFormat checks that the given output format is known, and
+// returns it.
+func ParseFormat(format string) (string, error) {
+	switch format {
+	case FormatText, FormatJSON, FormatNDJSON:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown output format %q", format)
+}
+
+// Structured reports whether commands should produce Records, rather
+// than text.
+func (ctx *Context) Structured() bool {
+	return ctx.Format == FormatJSON || ctx.Format == FormatNDJSON
+}
+
+// emitTask adds a Record describing the Task and the event which
+// happened to it to the output of the current command.
+func (ctx *Context) emitTask(event string, t Task) *TaskRecord {
+	r := NewTaskRecord(t)
+	ctx.records = append(ctx.records, Record{
+		Schema:     RecordSchema,
+		Kind:       RecordTask,
+		Event:      event,
+		TaskRecord: r,
+	})
+	return r
+}
+
+// warn reports a problem which does not stop the command, either as a
+// Record or on the prompt.
+func (ctx *Context) warn(format string, a ...interface{}) {
+	if !ctx.Structured() {
+		writePrompt(ctx, "Warning: "+format, a...)
+		return
+	}
+	ctx.records = append(ctx.records, Record{
+		Schema:  RecordSchema,
+		Kind:    RecordWarning,
+		Message: strings.TrimRight(fmt.Sprintf(format, a...), "\n"),
+	})
+}
+
+// reportError reports an error which stopped a command, either as a
+// Record following any others the command produced, or on the prompt.
+func reportError(ctx *Context, err error) {
+	if !ctx.Structured() {
+		writePrompt(ctx, "Error: %s\n", err)
+		return
+	}
+	ctx.records = append(ctx.records, errorRecord(err))
+	ctx.flushRecords()
+}
+
+// errorRecord gives the Record reporting the error.
+func errorRecord(err error) Record {
+	return Record{
+		Schema:  RecordSchema,
+		Kind:    RecordError,
+		Message: err.Error(),
+	}
+}
+
+// flushRecords writes the Records produced by the current command in
+// the selected format, and forgets them. Commands which produce no
+// Records write nothing, except that an empty list is written as an
+// empty array.
+func (ctx *Context) flushRecords() {
+	records := ctx.records
+	ctx.records = nil
+	if records == nil {
+		return
+	}
+
+	if ctx.Format == FormatJSON {
+		b, err := json.MarshalIndent(records, "", "\t")
+		if err == nil {
+			_, err = fmt.Fprintf(ctx.Output, "%s\n", b)
+		}
+		if err != nil {
+			writePrompt(ctx, "Error: %s\n", err)
+		}
+		return
+	}
+
+	enc := json.NewEncoder(ctx.Output)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			writePrompt(ctx, "Error: %s\n", err)
+			return
+		}
+	}
+}
+
+// emitAdded adds a Record describing a task which has just been added,
+// if the output is structured.
+func (ctx *Context) emitAdded(c TaskContainer) {
+	ctx.emitContainer(EventAdded, c)
+}
+
+// emitContainer adds a Record describing the task held by the
+// TaskContainer, if the output is structured. Recurring tasks are
+// described by their next occurrence, even if it is not listed yet.
+func (ctx *Context) emitContainer(event string, c TaskContainer) {
+	if !ctx.Structured() {
+		return
+	}
+	if t := ctx.fileList.List().taskOf(c); t != nil {
+		ctx.emitTask(event, t)
+	} else if g, ok := c.(*RecurringTaskGenerator); ok {
+		ctx.emitTask(event, g.SpawnTask(g.LastCompleted+1))
+	}
+}
@@ -0,0 +1,1187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// ICalUTCFormat and ICalLocalFormat are the formats of iCalendar
+	// date-times in UTC and in floating local time. ICalDateFormat is
+	// that of dates without a time.
+	ICalUTCFormat   = "20060102T150405Z"
+	ICalLocalFormat = "20060102T150405"
+	ICalDateFormat  = "20060102"
+
+	// ICalUIDSuffix follows the ID of a task in the UIDs of the
+	// iCalendar components describing it, so that they stay the same
+	// across exports.
+	ICalUIDSuffix = "@tasktogo"
+
+	// ICalProjectProperty is the non-standard property holding the
+	// project of a task.
+	ICalProjectProperty = "X-TASKTOGO-PROJECT"
+
+	// ICalLineLength is the number of octets after which lines are
+	// folded.
+	ICalLineLength = 75
+
+	// ExpandHorizon is how far ahead the occurrences of recurring
+	// tasks are exported, when they cannot be described by a rule.
+	// At most MaxExpanded are exported for each.
+	ExpandHorizon = 90 * 24 * time.Hour
+	MaxExpanded   = 1000
+)
+
+// icalWriter writes iCalendar content lines to an io.Writer. Once an
+// error occurs, nothing more is written, and it is kept in err.
+type icalWriter struct {
+	w   io.Writer
+	err error
+}
+
+// prop writes a content line, with the value as given, folding it
+// every ICalLineLength octets without splitting characters.
+func (iw *icalWriter) prop(name, value string) {
+	if iw.err != nil {
+		return
+	}
+	var b bytes.Buffer
+	line, max := name+":"+value, ICalLineLength
+	for len(line) > max {
+		n := max
+		for n > 0 && !utf8.RuneStart(line[n]) {
+			n--
+		}
+		b.WriteString(line[:n] + "\r\n ")
+		line = line[n:]
+
+		// Continuation lines begin with a space, which counts toward
+		// their length.
+		max = ICalLineLength - 1
+	}
+	b.WriteString(line + "\r\n")
+	_, iw.err = iw.w.Write(b.Bytes())
+}
+
+// text writes a content line with a text value, which is escaped.
+func (iw *icalWriter) text(name, value string) {
+	iw.prop(name, icalEscaper.Replace(value))
+}
+
+// icalEscaper escapes the characters which are special in iCalendar
+// text values.
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`,
+	"\r\n", `\n`, "\n", `\n`)
+
+// icalTime formats a date-time in UTC, or in floating local time if
+// floating is set.
+func icalTime(t time.Time, floating bool) string {
+	if floating {
+		return t.Format(ICalLocalFormat)
+	}
+	return t.UTC().Format(ICalUTCFormat)
+}
+
+// ICalPriority maps a priority onto the iCalendar PRIORITY scale, in
+// which 1 is the most urgent and 9 the least, and 0 is undefined.
+// Priorities beyond 9 are treated as 9.
+func ICalPriority(priority int) int {
+	switch {
+	case priority < 1:
+		return 0
+	case priority > 9:
+		return 9
+	}
+	return priority
+}
+
+// icalTodo describes a VTODO component. A recurring task has a Rule,
+// and the times on which it recurs are given by Start; other tasks
+// have a Due date, unless they are eventual. If RecurrenceID is set,
+// it replaces that occurrence of the recurring task with the same UID.
+type icalTodo struct {
+	UID                      string
+	Start, Due, RecurrenceID time.Time
+	Rule                     string
+	ExDates                  []time.Time
+
+	// Floating writes Start, RecurrenceID, and ExDates in floating
+	// local time, so that rules keep their time of day across changes
+	// in daylight saving time.
+	Floating bool
+
+	Summary, Description string
+	Priority             int
+	Project              string
+	Tags                 []string
+	Created              time.Time
+
+	// Parent is the UID of the task this is a subtask of, and Depends
+	// those of the tasks it depends on.
+	Parent  string
+	Depends []string
+}
+
+// icalTodo describes the task in the fileList with the given info,
+// which is a subtask of parent if it is not nil. Tasks which were
+// imported keep their UIDs, except for the instances of recurring
+// tasks.
+func (fl *fileList) icalTodo(info TaskInfo, parent TaskContainer) icalTodo {
+	uid := info.ID + ICalUIDSuffix
+	if info.UID != "" && info.Occurrence == 0 {
+		uid = info.UID
+	}
+	todo := icalTodo{
+		UID:         uid,
+		Due:         info.DueBy,
+		Summary:     info.Name,
+		Description: info.Description,
+		Priority:    info.Priority,
+		Project:     info.Project,
+		Tags:        info.Tags,
+		Created:     info.Created,
+	}
+	if parent != nil {
+		todo.Parent = icalUID(parent)
+	}
+	for _, id := range info.Depends {
+		uid := id + ICalUIDSuffix
+		if c := fl.container(id); c != nil {
+			uid = icalUID(c)
+		}
+		todo.Depends = append(todo.Depends, uid)
+	}
+	return todo
+}
+
+// icalUID returns the UID of the iCalendar component describing the
+// TaskContainer.
+func icalUID(c TaskContainer) string {
+	if uid := metaOf(c).UID; uid != "" {
+		return uid
+	}
+	return containerID(c) + ICalUIDSuffix
+}
+
+// todo writes the VTODO, stamped with the given time.
+func (iw *icalWriter) todo(todo icalTodo, stamp time.Time) {
+	iw.prop("BEGIN", "VTODO")
+	iw.prop("UID", todo.UID)
+	iw.prop("DTSTAMP", icalTime(stamp, false))
+	if !todo.Created.IsZero() {
+		iw.prop("CREATED", icalTime(todo.Created, false))
+	}
+	if !todo.RecurrenceID.IsZero() {
+		iw.prop("RECURRENCE-ID", icalTime(todo.RecurrenceID, todo.Floating))
+	}
+	if !todo.Start.IsZero() {
+		iw.prop("DTSTART", icalTime(todo.Start, todo.Floating))
+	}
+	if !todo.Due.IsZero() {
+		iw.prop("DUE", icalTime(todo.Due, false))
+	}
+	if todo.Rule != "" {
+		iw.prop("RRULE", todo.Rule)
+	}
+	for _, date := range todo.ExDates {
+		iw.prop("EXDATE", icalTime(date, todo.Floating))
+	}
+	iw.text("SUMMARY", todo.Summary)
+	if todo.Description != "" {
+		iw.text("DESCRIPTION", todo.Description)
+	}
+	if priority := ICalPriority(todo.Priority); priority != 0 {
+		iw.prop("PRIORITY", strconv.Itoa(priority))
+	}
+	if len(todo.Tags) > 0 {
+		tags := make([]string, len(todo.Tags))
+		for i, tag := range todo.Tags {
+			tags[i] = icalEscaper.Replace(tag)
+		}
+		iw.prop("CATEGORIES", strings.Join(tags, ","))
+	}
+	if todo.Project != "" {
+		iw.text(ICalProjectProperty, todo.Project)
+	}
+	if todo.Parent != "" {
+		iw.prop("RELATED-TO;RELTYPE=PARENT", todo.Parent)
+	}
+	for _, uid := range todo.Depends {
+		iw.prop("RELATED-TO;RELTYPE=DEPENDS-ON", uid)
+	}
+	iw.prop("STATUS", "NEEDS-ACTION")
+	iw.prop("END", "VTODO")
+}
+
+// ExportICal writes every outstanding task as an iCalendar VTODO.
+// Definite tasks are given their due dates, and eventual tasks none.
+// Recurring tasks are written as a single VTODO with a rule, along
+// with those of any occurrences which are overridden, or if they
+// cannot be described by a rule, as a VTODO for each occurrence up to
+// ExpandHorizon from now.
+func ExportICal(ctx *Context, w io.Writer) error {
+	iw := &icalWriter{w: w}
+	now := ctx.Now()
+
+	iw.prop("BEGIN", "VCALENDAR")
+	iw.prop("VERSION", "2.0")
+	iw.prop("PRODID", "-//tasktogo//tasktogo "+Version+"//EN")
+	ctx.fileList.walk(func(c, parent TaskContainer) {
+		g, ok := c.(*RecurringTaskGenerator)
+		if !ok {
+			iw.todo(ctx.fileList.icalTodo(c.(Task).Info(), parent), now)
+			return
+		}
+		for _, todo := range g.icalTodos(&ctx.fileList, parent, now) {
+			iw.todo(todo, now)
+		}
+	})
+	iw.prop("END", "VCALENDAR")
+	return iw.err
+}
+
+// icalTodos describes the outstanding tasks of the generator as of
+// now, as a VTODO with a rule if possible.
+func (g *RecurringTaskGenerator) icalTodos(fl *fileList,
+	parent TaskContainer, now time.Time) (todos []icalTodo) {
+
+	first := g.firstOutstanding()
+	rule, floating, ok := g.icalRule(first)
+	if !ok {
+		for _, t := range g.expand(now.Add(ExpandHorizon)) {
+			todos = append(todos, fl.icalTodo(t.Info(), parent))
+		}
+		return
+	}
+	if g.exhausted(first) {
+		return nil
+	}
+
+	todo := fl.icalTodo(TaskInfo{
+		ID:          g.ID,
+		Priority:    g.Spawn.Priority,
+		Name:        g.Spawn.Name,
+		Description: g.Spawn.Description,
+		Meta:        g.Spawn.Meta,
+	}, parent)
+	todo.Start = g.DueByID(first)
+	todo.Rule, todo.Floating = rule, floating
+
+	// Occurrences which have been completed since the first
+	// outstanding one, or skipped, are excluded from the rule, and
+	// those which are overridden are replaced.
+	outstanding := make(map[int]bool)
+	for _, id := range g.Except {
+		outstanding[id] = true
+	}
+	for n := first + 1; n <= g.LastCompleted; n++ {
+		if !outstanding[n] {
+			todo.ExDates = append(todo.ExDates, g.DueByID(n))
+		}
+	}
+	var overridden []int
+	for n, o := range g.Overrides {
+		if n < first || (n <= g.LastCompleted && !outstanding[n]) {
+			continue
+		}
+		if o.Skip {
+			todo.ExDates = append(todo.ExDates, g.DueByID(n))
+		} else {
+			overridden = append(overridden, n)
+		}
+	}
+	sort.Sort(timeSlice(todo.ExDates))
+	todos = append(todos, todo)
+
+	sort.Ints(overridden)
+	for _, n := range overridden {
+		t := g.SpawnTask(n)
+		o := todo
+		o.RecurrenceID, o.Start = g.DueByID(n), t.DueBy
+		o.Rule, o.ExDates = "", nil
+		o.Summary, o.Description, o.Priority = t.Name, t.Description,
+			t.Priority
+		todos = append(todos, o)
+	}
+	return
+}
+
+// firstOutstanding returns the earliest occurrence which has not been
+// completed.
+func (g *RecurringTaskGenerator) firstOutstanding() int {
+	first := g.LastCompleted + 1
+	for _, id := range g.Except {
+		if id < first {
+			first = id
+		}
+	}
+	return first
+}
+
+// icalRule describes the occurrences of the generator from the given
+// one onward as an iCalendar RRULE, if they can be. Recurrence rules
+// keep their time of day, so their times are floating; delays are
+// fixed durations, so theirs are in UTC. Tasks which recur after
+// completion, or have names which vary with the occurrence, cannot be
+// described by a rule.
+func (g *RecurringTaskGenerator) icalRule(first int) (rule string,
+	floating, ok bool) {
+
+	if g.AfterCompletion || strings.Contains(g.Spawn.Name, "%") ||
+		strings.Contains(g.Spawn.Description, "%") {
+		return "", false, false
+	}
+
+	if g.Rule != nil {
+		r := *g.Rule
+		if r.Count > 0 {
+			// The rule starts again at the first outstanding
+			// occurrence, so fewer are left.
+			if !g.End.IsZero() {
+				return "", false, false
+			}
+			r.Count -= first - 1
+		}
+		until := r.Until
+		if !g.End.IsZero() && (until.IsZero() || g.End.Before(until)) {
+			until = g.End
+		}
+		r.Until = time.Time{}
+		rule = r.String()
+		if !until.IsZero() {
+			rule += ";UNTIL=" + icalTime(until.In(g.Start.Location()), true)
+		}
+		return rule + ";WKST=MO", true, true
+	}
+
+	// Delays can only be described if they are all the same.
+	if len(g.Delay) == 0 {
+		return "", false, false
+	}
+	delay := g.Delay[0]
+	for _, d := range g.Delay {
+		if d != delay {
+			return "", false, false
+		}
+	}
+
+	var freq string
+	var interval time.Duration
+	for _, unit := range []struct {
+		freq     string
+		duration time.Duration
+	}{
+		{"WEEKLY", 7 * 24 * time.Hour},
+		{FreqDaily, 24 * time.Hour},
+		{"HOURLY", time.Hour},
+		{"MINUTELY", time.Minute},
+		{"SECONDLY", time.Second},
+	} {
+		if delay > 0 && delay%unit.duration == 0 {
+			freq, interval = unit.freq, delay/unit.duration
+			break
+		}
+	}
+	if freq == "" {
+		return "", false, false
+	}
+
+	rule = "FREQ=" + freq
+	if interval > 1 {
+		rule += fmt.Sprintf(";INTERVAL=%d", interval)
+	}
+	if !g.End.IsZero() {
+		rule += ";UNTIL=" + icalTime(g.End, false)
+	}
+	return rule, false, true
+}
+
+// expand returns the outstanding tasks of the generator, followed by
+// the occurrences due before the given time which have not yet been
+// produced, up to MaxExpanded in all. Only the next task is known for
+// tasks which recur after completion.
+func (g *RecurringTaskGenerator) expand(until time.Time) (tasks []*RecurringTask) {
+	last := g.LastCompleted
+	for _, t := range g.Tasks() {
+		r := t.(*RecurringTask)
+		tasks = append(tasks, r)
+		if r.Occurrence > last {
+			last = r.Occurrence
+		}
+	}
+	if g.AfterCompletion {
+		return
+	}
+
+	for n := last + 1; len(tasks) < MaxExpanded && !g.exhausted(n); n++ {
+		if due := g.DueByID(n); due.IsZero() || due.After(until) {
+			break
+		}
+		if !g.skipped(n) {
+			tasks = append(tasks, g.SpawnTask(n))
+		}
+	}
+	return
+}
+
+// timeSlice sorts times in increasing order. (For use with package
+// sort.)
+type timeSlice []time.Time
+
+func (s timeSlice) Len() int           { return len(s) }
+func (s timeSlice) Less(i, j int) bool { return s[i].Before(s[j]) }
+func (s timeSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// icalProp is a property of an iCalendar component, with its
+// parameters by name. Names are upper case, and values are as given.
+type icalProp struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// icalComponent is an iCalendar component, such as a VTODO, with its
+// properties by name. The components nested within it are left out.
+type icalComponent struct {
+	Name  string
+	Props map[string][]icalProp
+}
+
+// prop returns the first property with the given name, and whether
+// there is one.
+func (c *icalComponent) prop(name string) (icalProp, bool) {
+	props := c.Props[name]
+	if len(props) == 0 {
+		return icalProp{}, false
+	}
+	return props[0], true
+}
+
+// text returns the unescaped text of the first property with the given
+// name, or an empty string if there is none.
+func (c *icalComponent) text(name string) string {
+	p, _ := c.prop(name)
+	return icalUnescaper.Replace(p.Value)
+}
+
+// icalUnescaper reverses icalEscaper.
+var icalUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",",
+	`\n`, "\n", `\N`, "\n")
+
+// parseICal reads the VTODO and VEVENT components from an iCalendar
+// stream, unfolding its lines.
+func parseICal(r io.Reader) (comps []*icalComponent, err error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") ||
+			strings.HasPrefix(line, "\t")) {
+
+			lines[len(lines)-1] += line[1:]
+		} else if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Properties belong to the current component only if they are not
+	// nested within another, such as a VALARM.
+	var current *icalComponent
+	depth, currentDepth := 0, 0
+	for n, line := range lines {
+		p, err := parseICalProp(line)
+		if err != nil {
+			return nil, fmt.Errorf("content line %d: %s", n+1, err)
+		}
+
+		switch value := strings.ToUpper(p.Value); {
+		case p.Name == "BEGIN":
+			depth++
+			if current == nil && (value == "VTODO" || value == "VEVENT") {
+				current = &icalComponent{Name: value,
+					Props: make(map[string][]icalProp)}
+				currentDepth = depth
+			}
+		case p.Name == "END":
+			if current != nil && depth == currentDepth {
+				comps = append(comps, current)
+				current = nil
+			}
+			depth--
+		case current != nil && depth == currentDepth:
+			current.Props[p.Name] = append(current.Props[p.Name], p)
+		}
+	}
+	return comps, nil
+}
+
+// parseICalProp parses a content line, such as
+// "DTSTART;TZID=Europe/Paris:20261020T090000".
+func parseICalProp(line string) (p icalProp, err error) {
+	// The value follows the first colon which is not quoted within a
+	// parameter, and the parameters are separated likewise.
+	var parts []string
+	quoted, start := false, 0
+	for i, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case quoted:
+		case r == ';':
+			parts = append(parts, line[start:i])
+			start = i + 1
+		case r == ':':
+			parts = append(parts, line[start:i])
+			p.Value = line[i+1:]
+			return newICalProp(parts, p.Value)
+		}
+	}
+	return p, fmt.Errorf("expected name:value, got %q", line)
+}
+
+// newICalProp creates an icalProp from its name and parameters, as
+// given, and its value.
+func newICalProp(parts []string, value string) (icalProp, error) {
+	p := icalProp{
+		Name:   strings.ToUpper(parts[0]),
+		Params: make(map[string]string),
+		Value:  value,
+	}
+	for _, param := range parts[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return p, fmt.Errorf("invalid parameter %q", param)
+		}
+		p.Params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+	return p, nil
+}
+
+// splitICalList splits a value on the commas which are not escaped,
+// and unescapes each item.
+func splitICalList(value string) (items []string) {
+	start, escaped := 0, false
+	for i, r := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ',':
+			items = append(items, icalUnescaper.Replace(value[start:i]))
+			start = i + 1
+		}
+	}
+	return append(items, icalUnescaper.Replace(value[start:]))
+}
+
+// parseICalTime parses a date or date-time value of the property.
+// Times in UTC are converted to local time, and floating times are
+// taken to be in the zone given by TZID, or in local time. Dates are
+// taken to be due at the end of the working day.
+func parseICalTime(p icalProp, value string) (time.Time, error) {
+	if p.Params["VALUE"] == "DATE" || len(value) == len(ICalDateFormat) {
+		d, err := time.ParseInLocation(ICalDateFormat, value, time.Local)
+		if err != nil {
+			return d, err
+		}
+		return time.Date(d.Year(), d.Month(), d.Day(), EndOfDayHour, 0, 0,
+			0, time.Local), nil
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(ICalUTCFormat, value)
+		return t.Local(), err
+	}
+
+	loc := time.Local
+	if tzid := p.Params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	return time.ParseInLocation(ICalLocalFormat, value, loc)
+}
+
+// icalTask is a task read from an iCalendar component. It is
+// identified by its UID, and if it has a RecurrenceID, it replaces
+// that occurrence of the recurring task with the same UID.
+type icalTask struct {
+	uid string
+	c   TaskContainer
+
+	// parent is the UID of the task this is a subtask of, and depends
+	// those of the tasks it depends on.
+	parent  string
+	depends []string
+
+	recurrenceID time.Time
+	exDates      []time.Time
+
+	// status is the STATUS of the component, such as "COMPLETED", and
+	// completed the time at which it was completed, if it was.
+	status    string
+	completed time.Time
+
+	// before is the state of the task the component updates, as given
+	// by importState, if there was one, so that it is only counted as
+	// updated if it changes.
+	before []byte
+}
+
+// newICalTask reads a task from a VTODO or VEVENT. Components with
+// recurrence rules become recurring tasks, and others definite tasks
+// if they are dated, or eventual tasks if not. VTODOs are due at their
+// DUE date, or if they have none, their DTSTART, and VEVENTs at their
+// DTSTART.
+func newICalTask(comp *icalComponent) (t *icalTask, err error) {
+	t = &icalTask{
+		uid:    comp.text("UID"),
+		status: strings.ToUpper(comp.text("STATUS")),
+	}
+	if t.uid == "" {
+		return nil, errors.New("missing UID")
+	}
+
+	name := comp.text("SUMMARY")
+	description := comp.text("DESCRIPTION")
+	priority := DefaultPriority
+	if p, ok := comp.prop("PRIORITY"); ok {
+		n, err := strconv.Atoi(strings.TrimSpace(p.Value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority %q", p.Value)
+		}
+		if n > 0 {
+			priority = n
+		}
+	}
+
+	var m Meta
+	for _, p := range comp.Props["CATEGORIES"] {
+		for _, tag := range splitICalList(p.Value) {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				m.AddTag(tag)
+			}
+		}
+	}
+	m.Project = comp.text(ICalProjectProperty)
+	for _, p := range comp.Props["RELATED-TO"] {
+		switch strings.ToUpper(p.Params["RELTYPE"]) {
+		case "", "PARENT":
+			t.parent = icalUnescaper.Replace(p.Value)
+		case "DEPENDS-ON":
+			t.depends = append(t.depends, icalUnescaper.Replace(p.Value))
+		}
+	}
+
+	// Read each of the dates, in the order in which they are used.
+	times := make(map[string]time.Time)
+	for _, name := range []string{"DTSTART", "DUE", "CREATED",
+		"COMPLETED", "RECURRENCE-ID"} {
+
+		if p, ok := comp.prop(name); ok {
+			if times[name], err = parseICalTime(p, p.Value); err != nil {
+				return nil, fmt.Errorf("invalid %s %q", name, p.Value)
+			}
+		}
+	}
+	for _, p := range comp.Props["EXDATE"] {
+		for _, value := range strings.Split(p.Value, ",") {
+			date, err := parseICalTime(p, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid EXDATE %q", value)
+			}
+			t.exDates = append(t.exDates, date)
+		}
+	}
+	m.Created, t.completed = times["CREATED"], times["COMPLETED"]
+	t.recurrenceID = times["RECURRENCE-ID"]
+
+	due := times["DUE"]
+	if comp.Name == "VEVENT" || due.IsZero() {
+		due = times["DTSTART"]
+	}
+
+	rule, recurring := comp.prop("RRULE")
+	switch {
+	case recurring && t.recurrenceID.IsZero():
+		start, _ := comp.prop("DTSTART")
+		if start.Value == "" {
+			start, _ = comp.prop("DUE")
+		}
+		g, err := newICalGenerator(due, strings.HasSuffix(start.Value, "Z"),
+			rule.Value)
+		if err != nil {
+			return nil, err
+		}
+		g.Spawn.Name, g.Spawn.Description = name, description
+		g.Spawn.Priority, g.Spawn.Meta = priority, m
+		t.c = g
+	case due.IsZero():
+		t.c = &EventualTask{Priority: priority, Name: name,
+			Description: description, Meta: m}
+	default:
+		t.c = &DefiniteTask{Priority: priority, DueBy: due, Name: name,
+			Description: description, Meta: m}
+	}
+	return t, nil
+}
+
+// newICalGenerator creates a RecurringTaskGenerator starting at the
+// given time, which recurs according to the iCalendar RRULE. Rules
+// which recur by a fixed duration are given as a delay, as are daily
+// and weekly rules starting at a time in UTC, which cannot be affected
+// by daylight saving time. Others are kept as rules.
+func newICalGenerator(start time.Time, utc bool, rule string) (
+	*RecurringTaskGenerator, error) {
+
+	if start.IsZero() {
+		return nil, errors.New("recurrence rule without a start date")
+	}
+	g := &RecurringTaskGenerator{Start: start}
+
+	delay, end, ok, err := icalDelay(start, utc, rule)
+	if err != nil {
+		return nil, err
+	} else if ok {
+		g.Delay, g.End = []time.Duration{delay}, end
+		return g, nil
+	}
+
+	g.Rule, err = ParseRRule(rule)
+	return g, err
+}
+
+// icalDelay checks whether the rule recurs by a fixed duration,
+// returning it along with the time of the last occurrence, or the zero
+// time if there is no last occurrence.
+func icalDelay(start time.Time, utc bool, rule string) (delay time.Duration,
+	end time.Time, ok bool, err error) {
+
+	units := map[string]time.Duration{
+		"HOURLY":   time.Hour,
+		"MINUTELY": time.Minute,
+		"SECONDLY": time.Second,
+	}
+	if utc {
+		units["WEEKLY"] = 7 * 24 * time.Hour
+		units[FreqDaily] = 24 * time.Hour
+	}
+
+	interval, count := 1, 0
+	var until time.Time
+	for _, part := range strings.Split(strings.ToUpper(rule), ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return 0, end, false, nil
+		}
+		switch kv[0] {
+		case "FREQ":
+			delay = units[kv[1]]
+		case "INTERVAL":
+			interval, err = strconv.Atoi(kv[1])
+		case "COUNT":
+			count, err = strconv.Atoi(kv[1])
+		case "UNTIL":
+			until, err = parseUntil(kv[1])
+		case "WKST":
+		default:
+			return 0, end, false, nil
+		}
+		if err != nil {
+			return 0, end, false, fmt.Errorf("invalid %s %q", kv[0], kv[1])
+		}
+	}
+	if delay == 0 || interval < 1 {
+		return 0, end, false, nil
+	}
+
+	delay *= time.Duration(interval)
+	if count > 0 {
+		end = start.Add(time.Duration(count-1) * delay)
+	}
+	if !until.IsZero() && (end.IsZero() || until.Before(end)) {
+		end = until
+	}
+	return delay, end, true, nil
+}
+
+// imported returns the TaskContainer identified by an iCalendar UID,
+// either because it was imported with that UID, or because it was
+// exported with it, or nil if there is none.
+func (fl *fileList) imported(uid string) (c TaskContainer) {
+	fl.walk(func(other, _ TaskContainer) {
+		if c == nil && icalUID(other) == uid {
+			c = other
+		}
+	})
+	return
+}
+
+// exportedOccurrence returns the recurring task and occurrence number
+// identified by the UID of an exported occurrence, such as
+// "<id>:3@tasktogo", or nil if there is none.
+func (fl *fileList) exportedOccurrence(uid string) (
+	*RecurringTaskGenerator, int) {
+
+	if !strings.HasSuffix(uid, ICalUIDSuffix) {
+		return nil, 0
+	}
+	id := strings.TrimSuffix(uid, ICalUIDSuffix)
+	i := strings.LastIndex(id, ":")
+	if i < 0 {
+		return nil, 0
+	}
+	n, err := strconv.Atoi(id[i+1:])
+	g, ok := fl.container(id[:i]).(*RecurringTaskGenerator)
+	if err != nil || !ok || n < 1 {
+		return nil, 0
+	}
+	return g, n
+}
+
+// occurrenceAt returns the occurrence which is due at the given time,
+// if there is one.
+func (g *RecurringTaskGenerator) occurrenceAt(t time.Time) (int, bool) {
+	if g.AfterCompletion || t.Before(g.Start) {
+		return 0, false
+	}
+	last := g.FindLastID(t)
+	for n := last - 1; n <= last+1; n++ {
+		if n >= 1 && !g.exhausted(n) && g.DueByID(n).Equal(t) {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// finished checks whether the occurrence has been completed or
+// skipped.
+func (g *RecurringTaskGenerator) finished(occurrence int) bool {
+	if g.skipped(occurrence) {
+		return true
+	}
+	if occurrence > g.LastCompleted {
+		return false
+	}
+	for _, id := range g.Except {
+		if id == occurrence {
+			return false
+		}
+	}
+	return true
+}
+
+// sameSchedule checks whether the other generator produces the same
+// occurrences as this one, from some occurrence of this one onward, so
+// that this one can be kept along with its progress. Only the first
+// few occurrences are compared.
+func (g *RecurringTaskGenerator) sameSchedule(other *RecurringTaskGenerator) bool {
+	first, ok := g.occurrenceAt(other.Start)
+	if !ok || !g.End.Equal(other.End) {
+		return false
+	}
+	for k := 0; k < 10; k++ {
+		exhausted := g.exhausted(first + k)
+		if exhausted != other.exhausted(1+k) {
+			return false
+		} else if exhausted {
+			break
+		}
+		if !g.DueByID(first + k).Equal(other.DueByID(1 + k)) {
+			return false
+		}
+	}
+	return true
+}
+
+// update replaces the fields of the TaskContainer with those of one
+// read from an iCalendar component, keeping its identity, subtasks,
+// and dependencies, and returns the TaskContainer which is kept. The
+// progress of recurring tasks is kept if their schedule is the same.
+func (fl *fileList) update(old, new TaskContainer) TaskContainer {
+	oldMeta, newMeta := metaOf(old), metaOf(new)
+	oldMeta.Project, oldMeta.Tags = newMeta.Project, newMeta.Tags
+	if !newMeta.Created.IsZero() {
+		oldMeta.Created = newMeta.Created
+	}
+
+	switch o := old.(type) {
+	case *DefiniteTask:
+		if n, ok := new.(*DefiniteTask); ok {
+			o.DueBy = n.DueBy
+			break
+		}
+		return fl.replaceImported(old, new)
+	case *EventualTask:
+		if _, ok := new.(*EventualTask); !ok {
+			return fl.replaceImported(old, new)
+		}
+	case *RecurringTaskGenerator:
+		n, ok := new.(*RecurringTaskGenerator)
+		if !ok {
+			return fl.replaceImported(old, new)
+		}
+		if !o.sameSchedule(n) {
+			*o = RecurringTaskGenerator{
+				ID:       o.ID,
+				Alias:    o.Alias,
+				Start:    n.Start,
+				End:      n.End,
+				Delay:    n.Delay,
+				Rule:     n.Rule,
+				Backlog:  o.Backlog,
+				Spawn:    o.Spawn,
+				Subtasks: o.Subtasks,
+			}
+		}
+	}
+
+	oldName, oldDescription, oldPriority := commonFields(old)
+	newName, newDescription, newPriority := commonFields(new)
+	*oldName, *oldDescription, *oldPriority = *newName, *newDescription,
+		*newPriority
+	return old
+}
+
+// replaceImported replaces a TaskContainer with one of another kind
+// read from an iCalendar component, which takes on its identity,
+// subtasks, and dependencies.
+func (fl *fileList) replaceImported(old, new TaskContainer) TaskContainer {
+	oldID, oldAlias := old.(identity).identify()
+	newID, newAlias := new.(identity).identify()
+	*newID, *newAlias = *oldID, *oldAlias
+
+	oldMeta, newMeta := metaOf(old), metaOf(new)
+	newMeta.Depends, newMeta.UID = oldMeta.Depends, oldMeta.UID
+	if newMeta.Created.IsZero() {
+		newMeta.Created = oldMeta.Created
+	}
+	new.SetChildren(old.Children())
+
+	fl.Replace(old, new)
+	return new
+}
+
+// importOccurrence applies a component describing a single occurrence
+// of a recurring task, and reports whether it changed. Completed
+// occurrences are completed, cancelled ones skipped, and others
+// overridden where they differ.
+func (ctx *Context) importOccurrence(g *RecurringTaskGenerator, n int,
+	t *icalTask) bool {
+
+	if g.finished(n) {
+		return false
+	}
+	switch t.status {
+	case "COMPLETED":
+		completed := t.completed
+		if completed.IsZero() {
+			completed = ctx.Now()
+		}
+		ctx.fileList.Complete(g.SpawnTask(n), completed)
+		return true
+	case "CANCELLED":
+		g.Skip(n, &ctx.fileList)
+		return true
+	}
+
+	return g.overrideWith(n, t.c)
+}
+
+// overrideWith overrides the occurrence with the fields of the given
+// TaskContainer which differ from it, and reports whether the Override
+// changed. Its due date is only overridden if it is a Task with one.
+func (g *RecurringTaskGenerator) overrideWith(n int, c TaskContainer) bool {
+	due := g.DueByID(n)
+	spawned := g.SpawnTask(n)
+	var before Override
+	if o := g.Overrides[n]; o != nil {
+		before = *o
+	}
+	o := g.override(n)
+	name, description, priority := commonFields(c)
+	if t, ok := c.(Task); ok {
+		if d := t.Info().DueBy; !d.IsZero() && !d.Equal(due) {
+			o.DueBy = d
+		}
+	}
+	if *name != spawned.Name {
+		o.Name = *name
+	}
+	if *description != spawned.Description {
+		o.Description = *description
+	}
+	if *priority != spawned.Priority {
+		o.Priority = *priority
+	}
+	changed := !o.same(before)
+	if *o == (Override{}) {
+		delete(g.Overrides, n)
+		if len(g.Overrides) == 0 {
+			g.Overrides = nil
+		}
+	}
+	return changed
+}
+
+// ImportICal reads the VTODO and VEVENT components of an iCalendar
+// file into the fileList, as described by newICalTask. Components
+// whose UIDs match tasks which were imported or exported before update
+// those tasks instead, and completed ones complete them. Components
+// describing single occurrences of recurring tasks replace, complete,
+// or skip them. Components which cannot be read are skipped with a
+// warning.
+func ImportICal(ctx *Context, r io.Reader) (result Imported, err error) {
+	comps, err := parseICal(r)
+	if err != nil {
+		return result, err
+	}
+
+	var tasks, occurrences []*icalTask
+	for _, comp := range comps {
+		t, err := newICalTask(comp)
+		if err != nil {
+			ctx.warn("skipped %q: %s\n", comp.text("SUMMARY"), err)
+			continue
+		}
+		if t.recurrenceID.IsZero() {
+			tasks = append(tasks, t)
+		} else {
+			occurrences = append(occurrences, t)
+		}
+	}
+
+	fl := &ctx.fileList
+	var kept []*icalTask
+	for _, t := range tasks {
+		if g, n := fl.exportedOccurrence(t.uid); g != nil {
+			if ctx.importOccurrence(g, n, t) {
+				result.Updated++
+			}
+			continue
+		}
+
+		old := fl.imported(t.uid)
+		switch {
+		case t.status == "CANCELLED" || (old == nil && t.status == "COMPLETED"):
+			continue
+		case old == nil:
+			// Tasks exported by another list keep their UIDs, but not
+			// their IDs.
+			metaOf(t.c).UID = t.uid
+			fl.Add(t.c)
+			result.Added = append(result.Added, t.c)
+		case t.status == "COMPLETED":
+			if task, ok := old.(Task); ok {
+				completed := t.completed
+				if completed.IsZero() {
+					completed = ctx.Now()
+				}
+				fl.Complete(task, completed)
+				result.Completed++
+			}
+			continue
+		default:
+			t.before = importState(old)
+			t.c = fl.update(old, t.c)
+		}
+		kept = append(kept, t)
+	}
+
+	// Now that every task has been added, they can be nested beneath
+	// their parents, and given their dependencies and exceptions.
+	for _, t := range kept {
+		if parent := fl.imported(t.parent); parent != nil &&
+			fl.parentOf(t.c) == nil && isNew(result.Added, t.c) &&
+			parent != t.c && !t.c.Children().Contains(parent) {
+
+			fl.Remove(t.c)
+			fl.AddSubtask(parent, t.c)
+		}
+
+		// Components without DEPENDS-ON relations keep whichever
+		// dependencies the task already had, since other calendars
+		// may not know about them.
+		if len(t.depends) > 0 {
+			var depends []string
+			for _, uid := range t.depends {
+				if c := fl.imported(uid); c != nil && c != t.c {
+					depends = append(depends, containerID(c))
+				}
+			}
+			metaOf(t.c).Depends = depends
+		}
+
+		if g, ok := t.c.(*RecurringTaskGenerator); ok {
+			for _, date := range t.exDates {
+				if n, ok := g.occurrenceAt(date); ok && !g.finished(n) {
+					g.Skip(n, fl)
+				}
+			}
+		}
+	}
+	for _, t := range kept {
+		if t.before != nil && !bytes.Equal(t.before, importState(t.c)) {
+			result.Updated++
+		}
+	}
+
+	for _, t := range occurrences {
+		g, ok := fl.imported(t.uid).(*RecurringTaskGenerator)
+		if !ok {
+			ctx.warn("skipped %q: no recurring task with UID %s\n",
+				*t.name(), t.uid)
+			continue
+		}
+		n, ok := g.occurrenceAt(t.recurrenceID)
+		if !ok {
+			ctx.warn("skipped %q: no occurrence at %s\n", *t.name(),
+				t.recurrenceID.Format(DueFmt))
+			continue
+		}
+		if ctx.importOccurrence(g, n, t) {
+			result.Updated++
+		}
+	}
+	return result, nil
+}
+
+// importState encodes the TaskContainer without its subtasks, so that
+// it can be compared before and after importing.
+func importState(c TaskContainer) []byte {
+	children := c.Children()
+	c.SetChildren(nil)
+	defer c.SetChildren(children)
+
+	b, _ := json.Marshal(c)
+	return b
+}
+
+// name returns a pointer to the name of the task.
+func (t *icalTask) name() *string {
+	name, _, _ := commonFields(t.c)
+	return name
+}
+
+// isNew checks whether the TaskContainer is among those added.
+func isNew(added []TaskContainer, c TaskContainer) bool {
+	for _, a := range added {
+		if a == c {
+			return true
+		}
+	}
+	return false
+}
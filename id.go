@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MinIDPrefix is the shortest prefix of a task's ID which will be
+	// accepted in place of the whole ID.
+	MinIDPrefix = 4
+)
+
+var (
+	ErrNoTaskGiven = errors.New("no task given")
+	ErrNoMatch     = errors.New("no matching task")
+)
+
+// AmbiguousError is returned when a search term given to identify a
+// single task matches more than one.
+type AmbiguousError struct {
+	Term       string
+	Candidates []TaskInfo
+}
+
+func (err *AmbiguousError) Error() string {
+	lines := make([]string, 0, len(err.Candidates)+1)
+	lines = append(lines, fmt.Sprintf("%q matches more than one task:",
+		err.Term))
+	for _, info := range err.Candidates {
+		lines = append(lines, fmt.Sprintf("%6s  %s", info.Alias, info.Name))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// NewUUID produces a random (version 4) UUID in its usual string
+// form.
+func NewUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10],
+		b[10:16])
+}
+
+// identity is implemented by the tasks stored directly in a fileList,
+// which carry their own ID and alias.
+type identity interface {
+	identify() (id *string, alias *int)
+}
+
+func (t *DefiniteTask) identify() (*string, *int) { return &t.ID, &t.Alias }
+func (t *EventualTask) identify() (*string, *int) { return &t.ID, &t.Alias }
+func (g *RecurringTaskGenerator) identify() (*string, *int) {
+	return &g.ID, &g.Alias
+}
+
+// identities returns every task stored in the fileList, including
+// subtasks.
+func (fl *fileList) identities() (ids []identity) {
+	fl.walk(func(c, _ TaskContainer) {
+		ids = append(ids, c.(identity))
+	})
+	return
+}
+
+// AssignIDs gives every task in the fileList which doesn't have one a
+// UUID, and an alias which is not used by any other task. Tasks
+// without a creation time are considered created now. It returns true
+// if any were assigned.
+func (fl *fileList) AssignIDs() (assigned bool) {
+	ids := fl.identities()
+
+	// Find the aliases in use, so that a task with an alias used by
+	// an earlier task can be given a new one.
+	used := make(map[int]bool, len(ids))
+	max := 0
+	for _, t := range ids {
+		_, alias := t.identify()
+		if *alias > max {
+			max = *alias
+		}
+	}
+
+	for _, t := range ids {
+		id, alias := t.identify()
+		if *id == "" {
+			*id = NewUUID()
+			assigned = true
+		}
+		if m := metaOf(t.(TaskContainer)); m.Created.IsZero() {
+			m.Created = Now()
+			assigned = true
+		}
+		if *alias < 1 || used[*alias] {
+			max++
+			*alias = max
+			assigned = true
+		}
+		used[*alias] = true
+	}
+	return
+}
+
+// Add gives the TaskContainer an ID, and adds it to the appropriate
+// section of the fileList.
+func (fl *fileList) Add(c TaskContainer) {
+	fl.add(c)
+	fl.AssignIDs()
+}
+
+// add adds the TaskContainer to the appropriate section of the
+// fileList, without giving it an ID.
+func (fl *fileList) add(c TaskContainer) {
+	switch c := c.(type) {
+	case *DefiniteTask:
+		fl.Definite = append(fl.Definite, c)
+	case *EventualTask:
+		fl.Eventual = append(fl.Eventual, c)
+	case *RecurringTaskGenerator:
+		fl.Recurring = append(fl.Recurring, c)
+	}
+}
+
+// MatchesID checks whether the search term identifies the task
+// described by the TaskInfo by its ID or alias. A prefix of the ID is
+// accepted if it is at least MinIDPrefix characters long.
+func (info TaskInfo) MatchesID(term string) bool {
+	term = strings.ToLower(term)
+	return term == info.Alias || term == info.ID ||
+		(len(term) >= MinIDPrefix && strings.HasPrefix(info.ID, term))
+}
+
+// Find locates the single Task identified by the search term. The
+// term may be the task's ID, a prefix of it, its alias, or a prefix of
+// its name. If the alias of a recurring task is given, it identifies
+// its only outstanding instance. If more than one task matches, then
+// an *AmbiguousError listing them is returned.
+func (l List) Find(term string) (Task, error) {
+	term = strings.TrimSpace(term)
+	if term == "" {
+		return nil, ErrNoTaskGiven
+	}
+
+	// Try each way of identifying a task in turn, from the most to
+	// the least specific, and use the first which matches anything.
+	matchers := []func(Task) bool{
+		func(t Task) bool { return t.Info().MatchesID(term) },
+		func(t Task) bool {
+			_, err := strconv.Atoi(term)
+			return err == nil && strings.HasPrefix(t.Info().Alias, term+".")
+		},
+		func(t Task) bool { return strings.EqualFold(t.Info().Name, term) },
+		func(t Task) bool { return t.Match(term) },
+	}
+
+	for _, matches := range matchers {
+		var found []Task
+		for _, t := range l {
+			if matches(t) {
+				found = append(found, t)
+			}
+		}
+
+		switch len(found) {
+		case 0:
+			continue
+		case 1:
+			return found[0], nil
+		default:
+			err := &AmbiguousError{Term: term}
+			for _, t := range found {
+				err.Candidates = append(err.Candidates, t.Info())
+			}
+			return nil, err
+		}
+	}
+	return nil, ErrNoMatch
+}
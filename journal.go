@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/golang/glog"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// JournalSuffix is appended to the path of a list to form the
+	// path of its journal.
+	JournalSuffix = ".journal"
+
+	// JournalLength is the maximum number of entries kept in a
+	// journal. When it is exceeded, the oldest are discarded.
+	JournalLength = 100
+)
+
+var (
+	ErrNothingToUndo   = errors.New("nothing to undo")
+	ErrNothingToRedo   = errors.New("nothing to redo")
+	ErrJournalConflict = errors.New("list has changed since; " +
+		"cannot apply journal entry")
+)
+
+// Journal is a persistent record of the changes made to a fileList by
+// each command, which allows them to be undone and redone.
+type Journal struct {
+	// Entries is the list of recorded changes, oldest first.
+	Entries []*JournalEntry
+
+	// Position is the number of Entries which are currently
+	// applied. Those after it have been undone, and can be redone
+	// until another change is recorded.
+	Position int
+}
+
+// JournalEntry records the changes made to a fileList by a single
+// command.
+type JournalEntry struct {
+	Time    time.Time
+	Command string
+	Changes []Change
+}
+
+// Change describes the difference in one section of a fileList, such
+// as Definite, before and after a command. Each task is recorded in
+// its JSON encoding, so that Changes can describe any section without
+// knowing its type.
+type Change struct {
+	Section        string
+	Removed, Added []json.RawMessage `json:",omitempty"`
+}
+
+// sections is a fileList in which each section has been separated
+// into the JSON encodings of its elements.
+type sections map[string][]json.RawMessage
+
+// sections encodes the fileList and splits it into sections.
+func (fl fileList) sections() (sections, error) {
+	b, err := json.Marshal(fl)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]json.RawMessage
+	if err = json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+
+	s := make(sections, len(raw))
+	for name, section := range raw {
+		var elements []json.RawMessage
+		if err = json.Unmarshal(section, &elements); err != nil {
+			return nil, err
+		}
+		s[name] = elements
+	}
+	return s, nil
+}
+
+// fileList reassembles the sections into a fileList.
+func (s sections) fileList() (fl fileList, err error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &fl)
+	return
+}
+
+// Diff produces the Changes necessary to turn the receiver into the
+// given sections. Elements are compared by their encoding, so a task
+// which has been modified is recorded as removed and added again.
+func (s sections) Diff(after sections) (changes []Change) {
+	// Collect the names of all sections, in order, so that the
+	// Changes are always recorded in the same order.
+	seen := make(map[string]bool)
+	var names []string
+	for _, ss := range []sections{s, after} {
+		for name := range ss {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		// Count the elements before, and then cancel out the ones
+		// which are still there afterward.
+		count := make(map[string]int)
+		for _, element := range s[name] {
+			count[string(element)]++
+		}
+
+		change := Change{Section: name}
+		for _, element := range after[name] {
+			if count[string(element)] > 0 {
+				count[string(element)]--
+			} else {
+				change.Added = append(change.Added, element)
+			}
+		}
+		for _, element := range s[name] {
+			if count[string(element)] > 0 {
+				count[string(element)]--
+				change.Removed = append(change.Removed, element)
+			}
+		}
+
+		if len(change.Added) > 0 || len(change.Removed) > 0 {
+			changes = append(changes, change)
+		}
+	}
+	return
+}
+
+// Apply makes the given Changes to the sections, or reverses them if
+// reverse is true. If any element which is to be removed is not
+// present, because the list has been changed in the meantime, then
+// ErrJournalConflict is returned and the sections are not modified.
+func (s sections) Apply(changes []Change, reverse bool) error {
+	result := make(sections, len(s))
+	for name, elements := range s {
+		result[name] = append([]json.RawMessage(nil), elements...)
+	}
+
+	for _, change := range changes {
+		remove, add := change.Removed, change.Added
+		if reverse {
+			remove, add = add, remove
+		}
+
+		elements := result[change.Section]
+	removing:
+		for _, r := range remove {
+			for i, element := range elements {
+				if string(element) == string(r) {
+					elements = append(elements[:i], elements[i+1:]...)
+					continue removing
+				}
+			}
+			return ErrJournalConflict
+		}
+		result[change.Section] = append(elements, add...)
+	}
+
+	for name, elements := range result {
+		s[name] = elements
+	}
+	return nil
+}
+
+// ReadJournal decodes a JSON-encoded Journal from the given
+// io.Reader.
+func ReadJournal(r io.Reader) (j *Journal, err error) {
+	j = &Journal{}
+	err = json.NewDecoder(r).Decode(j)
+	return j, err
+}
+
+// ReadJournalFile wraps ReadJournal. If the file does not exist, an
+// empty Journal is returned.
+func ReadJournalFile(path string) (*Journal, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &Journal{}, nil
+	} else if err != nil {
+		return &Journal{}, err
+	}
+	defer f.Close()
+
+	return ReadJournal(f)
+}
+
+// Write JSON-encodes the Journal to the given io.Writer.
+func (j *Journal) Write(w io.Writer) error {
+	return json.NewEncoder(w).Encode(j)
+}
+
+// WriteFile wraps Write to encode the Journal to a file atomically.
+func (j *Journal) WriteFile(path string) error {
+	return writeFileAtomic(path, j.Write)
+}
+
+// Record adds an entry to the Journal, discarding any entries which
+// had been undone, and the oldest entries if it has grown too long.
+func (j *Journal) Record(entry *JournalEntry) {
+	j.Entries = append(j.Entries[:j.Position], entry)
+	if len(j.Entries) > JournalLength {
+		j.Entries = j.Entries[len(j.Entries)-JournalLength:]
+	}
+	j.Position = len(j.Entries)
+}
+
+// Undo reverses the most recently applied entry on the given
+// fileList, and returns it.
+func (j *Journal) Undo(fl *fileList) (*JournalEntry, error) {
+	if j.Position == 0 {
+		return nil, ErrNothingToUndo
+	}
+	entry := j.Entries[j.Position-1]
+	if err := applyEntry(fl, entry, true); err != nil {
+		return nil, err
+	}
+	j.Position--
+	return entry, nil
+}
+
+// Redo re-applies the most recently undone entry on the given
+// fileList, and returns it.
+func (j *Journal) Redo(fl *fileList) (*JournalEntry, error) {
+	if j.Position == len(j.Entries) {
+		return nil, ErrNothingToRedo
+	}
+	entry := j.Entries[j.Position]
+	if err := applyEntry(fl, entry, false); err != nil {
+		return nil, err
+	}
+	j.Position++
+	return entry, nil
+}
+
+// applyEntry applies or reverses the Changes in a JournalEntry on the
+// given fileList, replacing it.
+func applyEntry(fl *fileList, entry *JournalEntry, reverse bool) error {
+	s, err := fl.sections()
+	if err != nil {
+		return err
+	}
+	if err = s.Apply(entry.Changes, reverse); err != nil {
+		return err
+	}
+	newfl, err := s.fileList()
+	if err != nil {
+		return err
+	}
+
+	// Lines of a todo.txt list which could not be read are not part
+	// of the sections, and are kept as they are.
+	newfl.unread = fl.unread
+	*fl = newfl
+	return nil
+}
+
+// journalCommand wraps the Run function of a Command, and records the
+// changes it makes to the fileList in the Context's journal. Commands
+// which manipulate the journal themselves set ctx.skipJournal.
+func journalCommand(c *Command, ctx *Context) error {
+	var err error
+	ctx.before, err = ctx.fileList.sections()
+	if err != nil {
+		return err
+	}
+
+	ctx.skipJournal = false
+	runErr := c.Run(c, ctx)
+	if ctx.skipJournal {
+		return runErr
+	}
+
+	// Lists kept in the todo.txt format hold less than the fileList
+	// does, so the changes are recorded as they will be stored, and
+	// can be undone once the list has been read back.
+	if IsTodoTxt(ctx.loadpath) {
+		if err := ctx.fileList.asTodoTxt(); err != nil {
+			glog.Errorf("Could not record command in journal: %s\n", err)
+			return runErr
+		}
+	}
+
+	after, err := ctx.fileList.sections()
+	if err != nil {
+		glog.Errorf("Could not record command in journal: %s\n", err)
+		return runErr
+	}
+	if changes := ctx.before.Diff(after); len(changes) > 0 {
+		ctx.journal.Record(&JournalEntry{
+			Time:    ctx.Now(),
+			Command: c.String(),
+			Changes: changes,
+		})
+		ctx.journalModified = true
+	}
+	return runErr
+}
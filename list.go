@@ -30,8 +30,8 @@ func (l List) Len() int {
 	return len(l)
 }
 
-// Less returns whether the Task at index i has a lower nice value
-// (priority * (due date - now)) than that at index j. (For use with
+// Less returns whether the Task at index i has a lower nice value, as
+// calculated by the UrgencyModel, than that at index j. (For use with
 // package sort.)
 func (l List) Less(i, j int) bool {
 	// Retrieve both values so that they don't have to be looked up
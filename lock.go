@@ -0,0 +1,54 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// LockSuffix is appended to the path of a list to form the path of
+// the sidecar file used to lock it.
+const LockSuffix = ".lock"
+
+// fileLock is an advisory lock held on the sidecar lock file of a
+// list, which prevents other tasktogo processes from reading and
+// writing the list while it is held.
+type fileLock struct {
+	f *os.File
+}
+
+// LockFile acquires an exclusive lock on the list at path, blocking
+// until any other process holding it has released it. The lock file
+// is created if it does not exist, and is never removed, because
+// removing it would allow two processes to lock different files.
+func LockFile(path string) (*fileLock, error) {
+	f, err := os.OpenFile(path+LockSuffix, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retry if the wait is interrupted by a signal.
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileLock{f}, nil
+}
+
+// Unlock releases the lock. Closing the file releases it as well, but
+// it is done explicitly so that errors are visible.
+func (l *fileLock) Unlock() error {
+	err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,19 @@
+package main
+
+// LockSuffix is appended to the path of a list to form the path of
+// the sidecar file used to lock it.
+const LockSuffix = ".lock"
+
+// fileLock is a stand-in for the advisory lock used on other systems.
+// Windows has no flock, so lists are not locked there.
+type fileLock struct{}
+
+// LockFile does nothing on Windows, and always succeeds.
+func LockFile(path string) (*fileLock, error) {
+	return &fileLock{}, nil
+}
+
+// Unlock does nothing on Windows.
+func (l *fileLock) Unlock() error {
+	return nil
+}
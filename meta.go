@@ -0,0 +1,173 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// ProjectPrefix begins an argument which gives a task's project.
+	ProjectPrefix = "project:"
+
+	// DependsPrefix begins an argument which gives the tasks that a
+	// task depends on, separated by commas.
+	DependsPrefix = "depends:"
+)
+
+// Meta holds information which can be attached to any kind of task.
+// It is embedded in each, so that its fields are stored alongside
+// theirs.
+type Meta struct {
+	// Project is the name of the project the task belongs to.
+	// Projects may be nested by separating their names with dots, as
+	// in "infra.web".
+	Project string `json:",omitempty"`
+
+	// Tags is a sorted list of labels attached to the task.
+	Tags []string `json:",omitempty"`
+
+	// Contexts are those of the Tags which were read from todo.txt
+	// contexts, such as "@phone", rather than projects, so that they
+	// are written back the same way.
+	Contexts []string `json:",omitempty"`
+
+	// Depends is a list of the IDs of tasks which must be completed
+	// before this one. A recurring task given by the ID of its
+	// generator blocks until none of its instances are outstanding.
+	Depends []string `json:",omitempty"`
+
+	// Created is the time at which the task was added.
+	Created time.Time
+
+	// UID identifies a task which was imported from another program,
+	// such as by the UID of an iCalendar component, so that it can be
+	// updated when imported again.
+	UID string `json:",omitempty"`
+
+	// blockers are the listed tasks which this one depends on, and
+	// dependents those which depend on it. They are found each time
+	// the List is generated.
+	blockers, dependents []Task
+
+	// depth is the number of tasks this one is nested beneath as a
+	// subtask, and subtasks and subtasksDone count its own subtasks.
+	// They are found each time the List is generated.
+	depth, subtasks, subtasksDone int
+}
+
+// Metadata returns the Meta, so that it can be retrieved from any Task
+// which embeds it.
+func (m *Meta) Metadata() *Meta {
+	return m
+}
+
+// stored returns a copy of the Meta with only the fields which are
+// stored, leaving out those found when the List is generated.
+func (m Meta) stored() Meta {
+	return Meta{Project: m.Project, Tags: m.Tags, Contexts: m.Contexts,
+		Depends: m.Depends, Created: m.Created, UID: m.UID}
+}
+
+// HasTag checks whether the task has been given the tag.
+func (m *Meta) HasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddTag attaches a tag to the task, if it doesn't already have it.
+func (m *Meta) AddTag(tag string) {
+	if m.HasTag(tag) {
+		return
+	}
+	m.Tags = append(m.Tags, tag)
+	sort.Strings(m.Tags)
+}
+
+// IsContext checks whether the tag was given as a todo.txt context.
+func (m *Meta) IsContext(tag string) bool {
+	for _, c := range m.Contexts {
+		if strings.EqualFold(c, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveTag removes a tag from the task, if it has it.
+func (m *Meta) RemoveTag(tag string) {
+	for i, t := range m.Tags {
+		if strings.EqualFold(t, tag) {
+			m.Tags = append(m.Tags[:i], m.Tags[i+1:]...)
+			return
+		}
+	}
+}
+
+// InProject checks whether the task belongs to the given project, or
+// to one nested inside it, ignoring case.
+func (m *Meta) InProject(project string) bool {
+	p, project := strings.ToLower(m.Project), strings.ToLower(project)
+	return p == project || strings.HasPrefix(p, project+".")
+}
+
+// Labels formats the project, tags, and the aliases of any tasks
+// blocking this one as they would be given on the command line,
+// preceded by a space, or returns an empty string if there are none.
+// The progress of the task's subtasks comes first, if it has any.
+func (m *Meta) Labels() string {
+	progress := progressLabel(m.subtasksDone, m.subtasks)
+	var labels []string
+	if m.Project != "" {
+		labels = append(labels, ProjectPrefix+m.Project)
+	}
+	for _, tag := range m.Tags {
+		labels = append(labels, "+"+tag)
+	}
+	if len(m.blockers) > 0 {
+		labels = append(labels, DependsPrefix+blockerAliases(m.blockers))
+	}
+	if len(labels) == 0 {
+		return progress
+	}
+	return progress + " " + strings.Join(labels, " ")
+}
+
+// tagArgument checks whether the argument is a tag, such as "+urgent"
+// or "-urgent", and returns the sign and tag if so. A tag must begin
+// with a letter, so that arguments such as "+3d" are not mistaken for
+// one.
+func tagArgument(arg string) (sign byte, tag string, ok bool) {
+	if len(arg) < 2 || (arg[0] != '+' && arg[0] != '-') {
+		return 0, "", false
+	}
+	if !unicode.IsLetter([]rune(arg[1:])[0]) {
+		return 0, "", false
+	}
+	return arg[0], arg[1:], true
+}
+
+// ExtractMeta removes "+tag", "project:name", and "depends:task"
+// arguments from the given arguments, and returns the rest along with
+// the Meta they describe. The tasks depended on are given as they were
+// in the arguments, and must be resolved to IDs with ResolveDepends.
+func ExtractMeta(args []string) (rest []string, m Meta) {
+	for _, arg := range args {
+		if sign, tag, ok := tagArgument(arg); ok && sign == '+' {
+			m.AddTag(tag)
+		} else if strings.HasPrefix(arg, ProjectPrefix) {
+			m.Project = strings.TrimPrefix(arg, ProjectPrefix)
+		} else if strings.HasPrefix(arg, DependsPrefix) {
+			m.Depends = append(m.Depends, strings.FieldsFunc(
+				strings.TrimPrefix(arg, DependsPrefix), isTagSeparator)...)
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	return
+}
@@ -0,0 +1,630 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoFields      = errors.New("no fields to modify given")
+	ErrCannotConvert = errors.New("recurring tasks cannot be converted")
+	ErrNeedsDue      = errors.New("definite tasks need a due date")
+	ErrChangedID     = errors.New("task ID cannot be changed")
+	ErrNotRecurring  = errors.New("only recurring tasks have this field")
+	ErrInvalidDelay  = errors.New("delays must be positive")
+	ErrMissingName   = errors.New("no task name given")
+	ErrMissingStart  = errors.New("recurring tasks need a start date")
+	ErrMissingDelay  = errors.New("recurring tasks need a delay or rule")
+	ErrEditConflict  = errors.New("task was changed while being edited")
+
+	ErrRuleAfterCompletion = errors.New("recurrence rules cannot be " +
+		"relative to completion")
+	ErrRecurringOnDue = errors.New("recurring tasks have a start, not a due date")
+)
+
+// Modification is a change to a single field of a task, given as
+// field=value.
+type Modification struct {
+	Field, Value string
+}
+
+// ParseModifications separates arguments of the form field=value from
+// those which precede them, which identify the task. Any arguments
+// after a modification which don't contain an equals sign are
+// considered part of its value, so that values may contain spaces.
+// After the first modification, arguments which add or remove tags,
+// set the project, or add dependencies are modifications as well.
+// Before it, they are filter terms like "priority<=3", which identify
+// the tasks to modify.
+func ParseModifications(args []string) (ref []string, mods []Modification) {
+	for _, arg := range args {
+		// Tags may be added and removed with "+tag" and "-tag", and
+		// the project set with "project:name", as when adding tasks,
+		// but only once a field=value has ended the filter.
+		if len(mods) == 0 && isFilterTerm(arg) {
+			ref = append(ref, arg)
+		} else if sign, tag, ok := tagArgument(arg); ok {
+			mods = append(mods, Modification{string(sign), tag})
+		} else if strings.HasPrefix(arg, ProjectPrefix) {
+			mods = append(mods, Modification{"project",
+				strings.TrimPrefix(arg, ProjectPrefix)})
+		} else if strings.HasPrefix(arg, DependsPrefix) {
+			mods = append(mods, Modification{"+depends",
+				strings.TrimPrefix(arg, DependsPrefix)})
+		} else if isFilterTerm(arg) {
+			ref = append(ref, arg)
+		} else if i := strings.Index(arg, "="); i > 0 {
+			mods = append(mods, Modification{
+				Field: strings.ToLower(arg[:i]),
+				Value: arg[i+1:],
+			})
+		} else if len(mods) > 0 {
+			last := &mods[len(mods)-1]
+			last.Value = strings.TrimLeft(last.Value+" "+arg, " ")
+		} else {
+			ref = append(ref, arg)
+		}
+	}
+	return
+}
+
+// Apply makes the Modification to the given TaskContainer, and
+// returns the result. If the task is converted to another kind, such
+// as by giving an eventual task a due date, then the result is a new
+// TaskContainer with the same ID.
+func (m Modification) Apply(c TaskContainer) (TaskContainer, error) {
+	name, description, priority := commonFields(c)
+	g, isRecurring := c.(*RecurringTaskGenerator)
+
+	var err error
+	switch m.Field {
+	case "name":
+		*name = m.Value
+	case "description", "desc":
+		*description = m.Value
+	case "priority", "pri":
+		*priority, err = strconv.Atoi(m.Value)
+
+	case "project":
+		metaOf(c).Project = m.Value
+	case "tags":
+		metaOf(c).Tags = nil
+		for _, tag := range strings.FieldsFunc(m.Value, isTagSeparator) {
+			metaOf(c).AddTag(tag)
+		}
+	case "+":
+		metaOf(c).AddTag(m.Value)
+	case "-":
+		metaOf(c).RemoveTag(m.Value)
+
+	case "depends", "+depends":
+		// The tasks depended on must already have been resolved to
+		// IDs, such as by resolveDepends.
+		if m.Field == "depends" {
+			metaOf(c).Depends = nil
+		}
+		for _, id := range strings.FieldsFunc(m.Value, isTagSeparator) {
+			metaOf(c).removeDepends(id)
+			metaOf(c).Depends = append(metaOf(c).Depends, id)
+		}
+
+	case "due":
+		if isRecurring {
+			return c, ErrRecurringOnDue
+		}
+		if m.Value == "" || m.Value == "none" {
+			return convert(c, TypeEventual, time.Time{})
+		}
+		due, err := ParseDate(m.Value, Now())
+		if err != nil {
+			return c, err
+		}
+		return convert(c, TypeDefinite, due)
+
+	case "type":
+		if isRecurring {
+			return c, ErrCannotConvert
+		}
+		var due time.Time
+		if t, ok := c.(*DefiniteTask); ok {
+			due = t.DueBy
+		}
+		return convert(c, strings.ToLower(m.Value), due)
+
+	case "start", "end":
+		if !isRecurring {
+			return c, ErrNotRecurring
+		}
+		var date time.Time
+		if m.Value != "" && m.Value != "none" {
+			date, err = ParseDate(m.Value, Now())
+		}
+		if m.Field == "start" {
+			g.Start = date
+		} else {
+			g.End = date
+		}
+
+	case "delay", "after":
+		if !isRecurring {
+			return c, ErrNotRecurring
+		}
+		g.Delay, err = ParseDelays(m.Value)
+		g.Rule, g.AfterCompletion = nil, m.Field == "after"
+
+	case "backlog":
+		if !isRecurring {
+			return c, ErrNotRecurring
+		}
+		g.Backlog, err = ParseBacklogPolicy(m.Value)
+
+	case "rule", "rrule":
+		if !isRecurring {
+			return c, ErrNotRecurring
+		}
+		rule, err := ParseRRule(m.Value)
+		if err != nil {
+			return c, err
+		}
+		g.Delay, g.Rule, g.AfterCompletion = nil, rule, false
+
+	default:
+		return c, fmt.Errorf("unknown field %q", m.Field)
+	}
+	return c, err
+}
+
+// commonFields returns pointers to the fields which all kinds of task
+// have. For recurring tasks, they are those of the spawned tasks.
+func commonFields(c TaskContainer) (name, description *string,
+	priority *int) {
+
+	switch c := c.(type) {
+	case *DefiniteTask:
+		return &c.Name, &c.Description, &c.Priority
+	case *EventualTask:
+		return &c.Name, &c.Description, &c.Priority
+	case *RecurringTaskGenerator:
+		return &c.Spawn.Name, &c.Spawn.Description, &c.Spawn.Priority
+	}
+	panic("unknown TaskContainer")
+}
+
+// metaOf returns a pointer to the Meta of a TaskContainer. For
+// recurring tasks, it is that of the spawned tasks.
+func metaOf(c TaskContainer) *Meta {
+	switch c := c.(type) {
+	case *DefiniteTask:
+		return &c.Meta
+	case *EventualTask:
+		return &c.Meta
+	case *RecurringTaskGenerator:
+		return &c.Spawn.Meta
+	}
+	panic("unknown TaskContainer")
+}
+
+// isTagSeparator reports whether r separates tags in a list of them.
+func isTagSeparator(r rune) bool {
+	return r == ',' || r == ' '
+}
+
+// convert turns a definite or eventual task into the given type,
+// keeping its identity and subtasks. Definite tasks are given the due
+// date.
+func convert(c TaskContainer, to string, due time.Time) (TaskContainer, error) {
+	var t *DefiniteTask
+	switch c := c.(type) {
+	case *DefiniteTask:
+		t = c
+	case *EventualTask:
+		t = &DefiniteTask{
+			ID:          c.ID,
+			Alias:       c.Alias,
+			Priority:    c.Priority,
+			Name:        c.Name,
+			Description: c.Description,
+			Meta:        c.Meta,
+			Subtasks:    c.Subtasks,
+		}
+	default:
+		return c, ErrCannotConvert
+	}
+
+	switch to {
+	case TypeDefinite:
+		if due.IsZero() {
+			return c, ErrNeedsDue
+		}
+		t.DueBy = due
+		return t, nil
+	case TypeEventual:
+		return &EventualTask{
+			ID:          t.ID,
+			Alias:       t.Alias,
+			Priority:    t.Priority,
+			Name:        t.Name,
+			Description: t.Description,
+			Meta:        t.Meta,
+			Subtasks:    t.Subtasks,
+		}, nil
+	}
+	return c, fmt.Errorf("unknown task type %q", to)
+}
+
+// Validate checks that the TaskContainer has everything its kind of
+// task needs to be listed.
+func Validate(c TaskContainer) error {
+	name, _, priority := commonFields(c)
+	if strings.TrimSpace(*name) == "" {
+		return ErrMissingName
+	}
+	if *priority == 0 {
+		return ErrMissingPriority
+	}
+
+	switch c := c.(type) {
+	case *DefiniteTask:
+		if c.DueBy.IsZero() {
+			return ErrNeedsDue
+		}
+	case *RecurringTaskGenerator:
+		if c.Start.IsZero() {
+			return ErrMissingStart
+		}
+		if len(c.Delay) == 0 && c.Rule == nil {
+			return ErrMissingDelay
+		}
+		if c.AfterCompletion && c.Rule != nil {
+			return ErrRuleAfterCompletion
+		}
+		for _, delay := range c.Delay {
+			if delay <= 0 {
+				return ErrInvalidDelay
+			}
+		}
+	}
+	return nil
+}
+
+// containerOf returns the TaskContainer which produced the given
+// Task, and which holds its data in the fileList.
+func containerOf(t Task) TaskContainer {
+	switch t := t.(type) {
+	case *DefiniteTask:
+		return t
+	case *EventualTask:
+		return t
+	case *RecurringTask:
+		return t.parent
+	}
+	panic("unknown Task")
+}
+
+// decodeContainer decodes JSON into a new TaskContainer of the same
+// kind as the given one. Unknown fields are rejected, so that
+// misspellings aren't silently ignored.
+func decodeContainer(b []byte, like TaskContainer) (TaskContainer, error) {
+	var c TaskContainer
+	switch like.(type) {
+	case *DefiniteTask:
+		c = &DefiniteTask{}
+	case *EventualTask:
+		c = &EventualTask{}
+	case *RecurringTaskGenerator:
+		c = &RecurringTaskGenerator{}
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	return c, d.Decode(c)
+}
+
+// Remove removes the TaskContainer from the fileList, wherever it is
+// among the subtasks, and returns true if it was found. Subtasks of
+// the TaskContainer are removed along with it.
+func (fl *fileList) Remove(c TaskContainer) bool {
+	if fl == nil {
+		return false
+	}
+
+	switch c := c.(type) {
+	case *DefiniteTask:
+		for i, t := range fl.Definite {
+			if t == c {
+				fl.Definite = append(fl.Definite[:i], fl.Definite[i+1:]...)
+				return true
+			}
+		}
+	case *EventualTask:
+		for i, t := range fl.Eventual {
+			if t == c {
+				fl.Eventual = append(fl.Eventual[:i], fl.Eventual[i+1:]...)
+				return true
+			}
+		}
+	case *RecurringTaskGenerator:
+		for i, g := range fl.Recurring {
+			if g == c {
+				fl.Recurring = append(fl.Recurring[:i],
+					fl.Recurring[i+1:]...)
+				return true
+			}
+		}
+	}
+
+	// Search the subtasks, and drop them entirely once the last is
+	// removed.
+	for _, parent := range fl.containers() {
+		if children := parent.Children(); children.Remove(c) {
+			if children.Empty() {
+				parent.SetChildren(nil)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Replace substitutes one TaskContainer for another in the fileList,
+// keeping it a subtask of the same parent if it was one.
+func (fl *fileList) Replace(old, new TaskContainer) {
+	parent := fl.parentOf(old)
+	fl.Remove(old)
+	fl.AddSubtask(parent, new)
+}
+
+func (c *Command) CmdModify(ctx *Context) (err error) {
+	glog.V(2).Infoln("User invoked modify")
+
+	ref, mods := ParseModifications(c.Args)
+	if len(mods) == 0 {
+		return ErrNoFields
+	}
+	if err = ctx.List.resolveDepends(mods); err != nil {
+		return err
+	}
+
+	tasks, err := ctx.List.Select(ref, ctx.Now())
+	if amb, ok := err.(*AmbiguousError); ok {
+		// Instances of a recurring task share a single generator,
+		// so a term matching several of them is not ambiguous here.
+		tasks, err = ctx.List.sameContainer(amb), nil
+		if tasks == nil {
+			return amb
+		}
+	} else if err != nil {
+		return err
+	}
+
+	// Several instances of a recurring task may match, but they share
+	// a single generator, which should only be modified once.
+	var containers []TaskContainer
+	seen := make(map[TaskContainer]bool)
+	for _, task := range tasks {
+		if c := containerOf(task); !seen[c] {
+			seen[c] = true
+			containers = append(containers, c)
+		}
+	}
+
+	// Modify every task before replacing any of them, so that the list
+	// is left alone if any of the modifications fail.
+	modified := make([]TaskContainer, len(containers))
+	for i, old := range containers {
+		if modified[i], err = modifyContainer(old, mods); err != nil {
+			return err
+		}
+	}
+	for i, old := range containers {
+		ctx.fileList.Replace(old, modified[i])
+	}
+	ctx.modified = true
+	for _, c := range modified {
+		ctx.emitContainer(EventModified, c)
+	}
+
+	// Dependencies which form a cycle can never be satisfied.
+	for _, t := range ctx.fileList.List() {
+		if cycle := dependencyCycle(t); cycle != nil {
+			ctx.warn("dependency cycle %s\n",
+				formatCycle(cycle))
+			break
+		}
+	}
+	return nil
+}
+
+// resolveDepends replaces the tasks given in dependency Modifications
+// with their IDs. Setting the dependencies to "none" removes them.
+func (l List) resolveDepends(mods []Modification) error {
+	for i, m := range mods {
+		if m.Field != "depends" && m.Field != "+depends" {
+			continue
+		}
+		if m.Value == "" || m.Value == "none" {
+			mods[i].Value = ""
+			continue
+		}
+
+		ids, err := l.ResolveDepends(
+			strings.FieldsFunc(m.Value, isTagSeparator))
+		if err != nil {
+			return err
+		}
+		mods[i].Value = strings.Join(ids, ",")
+	}
+	return nil
+}
+
+// sameContainer returns the tasks listed in the AmbiguousError if they
+// were all produced by the same TaskContainer, or nil otherwise.
+func (l List) sameContainer(amb *AmbiguousError) (tasks List) {
+	ids := make(map[string]bool)
+	for _, info := range amb.Candidates {
+		ids[info.ID] = true
+	}
+	for _, t := range l {
+		if !ids[t.Info().ID] {
+			continue
+		}
+		if len(tasks) > 0 && containerOf(t) != containerOf(tasks[0]) {
+			return nil
+		}
+		tasks = append(tasks, t)
+	}
+	return
+}
+
+// modifyContainer applies the Modifications to a copy of the given
+// TaskContainer, and validates the result.
+func modifyContainer(old TaskContainer, mods []Modification) (
+	TaskContainer, error) {
+
+	b, err := json.Marshal(old)
+	if err != nil {
+		return nil, err
+	}
+	modified, err := decodeContainer(b, old)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range mods {
+		modified, err = m.Apply(modified)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return modified, Validate(modified)
+}
+
+func (c *Command) CmdEdit(ctx *Context) (err error) {
+	glog.V(2).Infoln("User invoked edit")
+
+	task, err := ctx.List.Find(strings.Join(c.Args, " "))
+	if err != nil {
+		return err
+	}
+	old := containerOf(task)
+
+	// Write the task to a temporary file for the editor.
+	original, err := json.MarshalIndent(old, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile("", "tasktogo-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(append(original, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// Run the editor until the task it produces is valid, or the user
+	// gives up.
+	var edited TaskContainer
+	err = ctx.await(func() (err error) {
+		for {
+			if err = runEditor(f.Name()); err != nil {
+				return err
+			}
+
+			edited, err = readEdited(f.Name(), old)
+			if err == nil {
+				return nil
+			}
+
+			writePrompt(ctx, "Invalid task: %s\nEdit again? [Y/n] ", err)
+			answer, readErr := ctx.Input.ReadString('\n')
+			if readErr != nil || strings.HasPrefix(
+				strings.ToLower(strings.TrimSpace(answer)), "n") {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// The list may have been reloaded while the editor ran, so the
+	// task is found again, and must not have been changed meanwhile.
+	if old = ctx.fileList.container(containerID(old)); old == nil {
+		return ErrNoMatch
+	}
+	current, err := json.MarshalIndent(old, "", "\t")
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(original, current) {
+		return ErrEditConflict
+	}
+
+	result, err := json.MarshalIndent(edited, "", "\t")
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(original, result) {
+		writePrompt(ctx, "No changes made\n")
+		return nil
+	}
+
+	ctx.fileList.Replace(old, edited)
+	ctx.modified = true
+	return nil
+}
+
+// readEdited reads the task at path after it has been edited, and
+// checks that it is valid and has kept the ID of the original.
+func readEdited(path string, old TaskContainer) (TaskContainer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	edited, err := decodeContainer(b, old)
+	if err != nil {
+		return nil, err
+	}
+	if err = Validate(edited); err != nil {
+		return nil, err
+	}
+
+	oldID, _ := old.(identity).identify()
+	newID, _ := edited.(identity).identify()
+	if *oldID != *newID {
+		return nil, ErrChangedID
+	}
+	return edited, nil
+}
+
+// runEditor opens the file at path in the user's editor, as given by
+// $VISUAL or $EDITOR, and waits for it to exit.
+func runEditor(path string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	// The editor may be given with arguments, such as "emacs -nw".
+	args := append(strings.Fields(editor), path)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
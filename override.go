@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoOverrides = errors.New("no overrides given")
+)
+
+// Override replaces the fields of a single occurrence of a recurring
+// task. Fields which are left empty are not replaced. If Skip is set,
+// the occurrence is not produced at all.
+type Override struct {
+	DueBy             time.Time
+	Priority          int    `json:",omitempty"`
+	Name, Description string `json:",omitempty"`
+	Skip              bool   `json:",omitempty"`
+}
+
+// same reports whether the Override makes the same changes as the
+// other, comparing due dates by the instant they refer to, whatever
+// their location.
+func (o Override) same(other Override) bool {
+	due, otherDue := o.DueBy, other.DueBy
+	o.DueBy, other.DueBy = time.Time{}, time.Time{}
+	return o == other && due.Equal(otherDue)
+}
+
+// apply replaces the fields of a spawned task with those which are set
+// in the Override.
+func (o *Override) apply(t *RecurringTask) {
+	if !o.DueBy.IsZero() {
+		t.DueBy = o.DueBy
+	}
+	if o.Priority != 0 {
+		t.Priority = o.Priority
+	}
+	if o.Name != "" {
+		t.Name = o.Name
+	}
+	if o.Description != "" {
+		t.Description = o.Description
+	}
+}
+
+// override returns the Override for the given occurrence, creating it
+// if there is none.
+func (g *RecurringTaskGenerator) override(occurrence int) *Override {
+	if g.Overrides == nil {
+		g.Overrides = make(map[int]*Override)
+	}
+	o, ok := g.Overrides[occurrence]
+	if !ok {
+		o = &Override{}
+		g.Overrides[occurrence] = o
+	}
+	return o
+}
+
+// skipped checks whether the given occurrence has been skipped.
+func (g *RecurringTaskGenerator) skipped(occurrence int) bool {
+	o := g.Overrides[occurrence]
+	return o != nil && o.Skip
+}
+
+// Skip marks an occurrence so that it is no longer produced, without
+// completing it. For tasks which recur after completion, the next
+// occurrence is scheduled as though it had been completed.
+func (g *RecurringTaskGenerator) Skip(occurrence int, fl *fileList) {
+	g.override(occurrence).Skip = true
+	if g.AfterCompletion || occurrence <= g.LastCompleted+1 {
+		g.Done(occurrence, fl)
+	}
+}
+
+// pruneOverrides discards the Overrides of occurrences which have
+// already been completed or skipped, and so will not be produced again.
+func (g *RecurringTaskGenerator) pruneOverrides() {
+	outstanding := make(map[int]bool)
+	for _, id := range g.Except {
+		outstanding[id] = true
+	}
+	for occurrence := range g.Overrides {
+		if occurrence <= g.LastCompleted && !outstanding[occurrence] {
+			delete(g.Overrides, occurrence)
+		}
+	}
+	if len(g.Overrides) == 0 {
+		g.Overrides = nil
+	}
+}
+
+// upcoming finds an occurrence of a recurring task which is not yet
+// listed, because it is not yet due, by an alias or ID such as "3.12".
+func (fl *fileList) upcoming(term string) *RecurringTask {
+	i := strings.LastIndexAny(term, ".:")
+	if i < 0 {
+		return nil
+	}
+	occurrence, err := strconv.Atoi(term[i+1:])
+	if err != nil || occurrence < 1 {
+		return nil
+	}
+
+	var found *RecurringTask
+	fl.walk(func(c, _ TaskContainer) {
+		g, ok := c.(*RecurringTaskGenerator)
+		if !ok || found != nil || occurrence <= g.LastCompleted ||
+			g.exhausted(occurrence) ||
+			g.AfterCompletion && occurrence > g.LastCompleted+1 {
+			return
+		}
+		if t := g.SpawnTask(occurrence); t.Info().MatchesID(term) {
+			found = t
+		}
+	})
+	return found
+}
+
+// findOccurrence locates a single occurrence of a recurring task,
+// including those which are not yet listed, by the given arguments.
+func (ctx *Context) findOccurrence(args []string) (*RecurringTask, error) {
+	term := strings.Join(args, " ")
+	task, err := ctx.List.Find(term)
+	if err == ErrNoMatch {
+		if t := ctx.fileList.upcoming(term); t != nil {
+			return t, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t, ok := task.(*RecurringTask)
+	if !ok {
+		return nil, ErrNotRecurring
+	}
+	return t, nil
+}
+
+func (c *Command) CmdSkip(ctx *Context) (err error) {
+	glog.V(2).Infoln("User invoked skip")
+
+	t, err := ctx.findOccurrence(c.Args)
+	if err != nil {
+		return err
+	}
+
+	t.parent.Skip(t.Occurrence, &ctx.fileList)
+	ctx.modified = true
+	return nil
+}
+
+func (c *Command) CmdReschedule(ctx *Context) (err error) {
+	glog.V(2).Infoln("User invoked reschedule")
+
+	// The syntax is "reschedule task date", where both may be several
+	// words long, so split the arguments at the first point where the
+	// rest is a valid date.
+	for i := 1; i < len(c.Args); i++ {
+		due, err := ParseDate(strings.Join(c.Args[i:], " "), ctx.Now())
+		if err != nil {
+			continue
+		}
+		t, err := ctx.findOccurrence(c.Args[:i])
+		if err != nil {
+			return err
+		}
+
+		t.parent.override(t.Occurrence).DueBy = due
+		ctx.modified = true
+		return nil
+	}
+	return ErrNoDate
+}
+
+func (c *Command) CmdOverride(ctx *Context) (err error) {
+	glog.V(2).Infoln("User invoked override")
+
+	ref, mods := ParseModifications(c.Args)
+	if len(mods) == 0 {
+		return ErrNoOverrides
+	}
+	t, err := ctx.findOccurrence(ref)
+	if err != nil {
+		return err
+	}
+
+	// Apply the changes to a copy, so that the Override is left alone
+	// if any of them fail.
+	o := *t.parent.override(t.Occurrence)
+	for _, m := range mods {
+		switch m.Field {
+		case "due":
+			o.DueBy, err = ParseDate(m.Value, ctx.Now())
+		case "priority", "pri":
+			o.Priority, err = strconv.Atoi(m.Value)
+		case "name":
+			o.Name = m.Value
+		case "description", "desc":
+			o.Description = m.Value
+		default:
+			err = fmt.Errorf("cannot override field %q", m.Field)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	*t.parent.override(t.Occurrence) = o
+	ctx.modified = true
+	return nil
+}
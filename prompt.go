@@ -7,6 +7,10 @@ import (
 
 const (
 	PromptString = ": "
+
+	// DescriptionPromptString is the prompt used for each line of a
+	// multi-line task description.
+	DescriptionPromptString = "> "
 )
 
 // Prompt writes a prompt to the screen and reads the Input stream
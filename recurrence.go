@@ -0,0 +1,473 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FreqDaily   = "DAILY"
+	FreqWeekly  = "WEEKLY"
+	FreqMonthly = "MONTHLY"
+	FreqYearly  = "YEARLY"
+
+	// RulePrefix may begin a recurrence rule, as it does in iCalendar.
+	RulePrefix = "RRULE:"
+
+	// AfterCompletionPrefix begins the delays of a recurring task
+	// which recurs relative to when it was last completed.
+	AfterCompletionPrefix = "after:"
+
+	// maxEmptyPeriods is the number of consecutive periods without an
+	// occurrence after which a rule is considered to have none left,
+	// so that rules which can never match, such as the 30th of
+	// February, do not loop forever.
+	maxEmptyPeriods = 1000
+)
+
+var (
+	ErrMissingFreq = errors.New("recurrence rule needs FREQ")
+)
+
+var (
+	// untilFormats are the formats in which the UNTIL part of a rule is
+	// understood. Those without a zone are in local time.
+	untilFormats = []string{"20060102T150405Z", "20060102T150405",
+		"20060102"}
+
+	ruleWeekdays = map[string]time.Weekday{
+		"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday,
+		"WE": time.Wednesday, "TH": time.Thursday, "FR": time.Friday,
+		"SA": time.Saturday,
+	}
+)
+
+// RRule is a calendar-based recurrence rule, with the semantics of the
+// RRULE property of RFC 5545. Only the FREQ, INTERVAL, BYDAY,
+// BYMONTHDAY, BYSETPOS, COUNT, and UNTIL parts are supported, and weeks
+// begin on Monday, which WKST may only confirm. Occurrences are
+// generated from a start time, whose time of day they all share, even
+// across changes in daylight saving time.
+//
+// RRules are encoded as their textual form, such as
+// "FREQ=MONTHLY;BYDAY=TU;BYSETPOS=2" for the second Tuesday of every
+// month.
+type RRule struct {
+	Freq     string
+	Interval int
+
+	ByDay      []RuleDay
+	ByMonthDay []int
+	BySetPos   []int
+
+	// Count and Until limit the number of occurrences. If they are
+	// zero, the rule continues indefinitely.
+	Count int
+	Until time.Time
+}
+
+// RuleDay is a weekday in the BYDAY part of an RRule. If N is not zero,
+// it is the Nth such weekday of the month or year, counting from the
+// end if N is negative, such as -1FR for the last Friday.
+type RuleDay struct {
+	N       int
+	Weekday time.Weekday
+}
+
+// IsRule checks whether the argument looks like a recurrence rule,
+// rather than a list of delays.
+func IsRule(s string) bool {
+	return strings.Contains(strings.ToUpper(s), "FREQ=")
+}
+
+// ParseDelays parses a comma separated list of delays, in the format
+// understood by time.ParseDuration, or as a number of days or weeks,
+// such as "3d" or "2w".
+func ParseDelays(s string) (delays []time.Duration, err error) {
+	for _, delaystr := range strings.Split(s, ",") {
+		var unit time.Duration
+		switch {
+		case strings.HasSuffix(delaystr, "d"):
+			unit = 24 * time.Hour
+		case strings.HasSuffix(delaystr, "w"):
+			unit = 7 * 24 * time.Hour
+		}
+
+		var delay time.Duration
+		if unit != 0 {
+			n, err := strconv.ParseFloat(delaystr[:len(delaystr)-1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid delay %q", delaystr)
+			}
+			delay = time.Duration(n * float64(unit))
+		} else if delay, err = time.ParseDuration(delaystr); err != nil {
+			return nil, err
+		}
+		delays = append(delays, delay)
+	}
+	return delays, nil
+}
+
+// ParseRRule parses the textual form of a recurrence rule, such as
+// "FREQ=WEEKLY;BYDAY=MO,WE,FR", ignoring case.
+func ParseRRule(s string) (*RRule, error) {
+	s = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), RulePrefix)
+	r := &RRule{Interval: 1}
+
+	for _, part := range strings.Split(s, ";") {
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid recurrence rule part %q", part)
+		}
+
+		var err error
+		switch key, value := kv[0], kv[1]; key {
+		case "FREQ":
+			switch value {
+			case FreqDaily, FreqWeekly, FreqMonthly, FreqYearly:
+				r.Freq = value
+			default:
+				err = fmt.Errorf("unsupported frequency %q", value)
+			}
+		case "INTERVAL":
+			r.Interval, err = strconv.Atoi(value)
+			if err == nil && r.Interval < 1 {
+				err = errors.New("INTERVAL must be positive")
+			}
+		case "COUNT":
+			r.Count, err = strconv.Atoi(value)
+			if err == nil && r.Count < 1 {
+				err = errors.New("COUNT must be positive")
+			}
+		case "UNTIL":
+			r.Until, err = parseUntil(value)
+		case "BYDAY":
+			r.ByDay, err = parseRuleDays(value)
+		case "BYMONTHDAY":
+			r.ByMonthDay, err = parseRuleInts(value, 31)
+		case "BYSETPOS":
+			r.BySetPos, err = parseRuleInts(value, 366)
+		case "WKST":
+			if value != "MO" {
+				err = errors.New("weeks must start on Monday")
+			}
+		default:
+			err = fmt.Errorf("unsupported recurrence rule part %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if r.Freq == "" {
+		return nil, ErrMissingFreq
+	}
+	return r, nil
+}
+
+// parseUntil parses the UNTIL part of a rule. A date without a time
+// includes the whole of that day.
+func parseUntil(value string) (time.Time, error) {
+	for _, format := range untilFormats {
+		t, err := time.ParseInLocation(format, value, time.Local)
+		if err != nil {
+			continue
+		}
+		if len(value) == len("20060102") {
+			t = t.AddDate(0, 0, 1).Add(-time.Second)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid UNTIL %q", value)
+}
+
+// parseRuleDays parses a comma separated list of weekdays, each
+// optionally preceded by a signed position, such as "MO,-1FR".
+func parseRuleDays(value string) (days []RuleDay, err error) {
+	for _, s := range strings.Split(value, ",") {
+		if len(s) < 2 {
+			return nil, fmt.Errorf("invalid BYDAY %q", s)
+		}
+		wd, ok := ruleWeekdays[s[len(s)-2:]]
+		if !ok {
+			return nil, fmt.Errorf("invalid BYDAY %q", s)
+		}
+		day := RuleDay{Weekday: wd}
+		if n := s[:len(s)-2]; n != "" {
+			day.N, err = strconv.Atoi(n)
+			if err != nil || day.N == 0 || day.N < -53 || day.N > 53 {
+				return nil, fmt.Errorf("invalid BYDAY %q", s)
+			}
+		}
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+// parseRuleInts parses a comma separated list of non-zero integers
+// between -max and max.
+func parseRuleInts(value string, max int) (ns []int, err error) {
+	for _, s := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(s)
+		if err != nil || n == 0 || n < -max || n > max {
+			return nil, fmt.Errorf("invalid number %q in rule", s)
+		}
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
+
+// String produces the textual form of the rule, which ParseRRule
+// understands.
+func (r *RRule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		var days []string
+		for _, day := range r.ByDay {
+			days = append(days, day.String())
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		parts = append(parts, "BYMONTHDAY="+joinInts(r.ByMonthDay))
+	}
+	if len(r.BySetPos) > 0 {
+		parts = append(parts, "BYSETPOS="+joinInts(r.BySetPos))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format(untilFormats[0]))
+	}
+	return strings.Join(parts, ";")
+}
+
+func (d RuleDay) String() string {
+	s := strings.ToUpper(d.Weekday.String()[:2])
+	if d.N != 0 {
+		s = strconv.Itoa(d.N) + s
+	}
+	return s
+}
+
+// joinInts formats integers as a comma separated list.
+func joinInts(ns []int) string {
+	s := make([]string, len(ns))
+	for i, n := range ns {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ",")
+}
+
+// MarshalText encodes the RRule in its textual form.
+func (r *RRule) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText decodes the textual form of an RRule.
+func (r *RRule) UnmarshalText(text []byte) error {
+	parsed, err := ParseRRule(string(text))
+	if err != nil {
+		return err
+	}
+	*r = *parsed
+	return nil
+}
+
+// Occurrence returns the time of the given 1-indexed occurrence of the
+// rule, starting at start. If the rule ends before that occurrence,
+// the zero time is returned.
+func (r *RRule) Occurrence(start time.Time, occurrence int) (t time.Time) {
+	if occurrence < 1 {
+		return
+	}
+	r.each(start, func(n int, next time.Time) bool {
+		if n == occurrence {
+			t = next
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// CountBefore returns the number of occurrences of the rule, starting
+// at start, which are not after t.
+func (r *RRule) CountBefore(start, t time.Time) (count int) {
+	r.each(start, func(n int, next time.Time) bool {
+		if next.After(t) {
+			return false
+		}
+		count = n
+		return true
+	})
+	return
+}
+
+// each calls fn with every occurrence of the rule, starting at start,
+// along with its 1-indexed occurrence number, until fn returns false or
+// the rule ends.
+func (r *RRule) each(start time.Time, fn func(n int, t time.Time) bool) {
+	n, empty := 0, 0
+	for period := 0; empty < maxEmptyPeriods; period++ {
+		candidates := r.expand(start, period)
+		if len(candidates) == 0 {
+			empty++
+			continue
+		}
+		empty = 0
+
+		for _, t := range candidates {
+			if t.Before(start) {
+				continue
+			}
+			if !r.Until.IsZero() && t.After(r.Until) {
+				return
+			}
+			n++
+			if !fn(n, t) || (r.Count > 0 && n >= r.Count) {
+				return
+			}
+		}
+	}
+}
+
+// expand returns the occurrences of the rule in the given period, which
+// is the number of intervals since the one containing start, in order.
+func (r *RRule) expand(start time.Time, period int) []time.Time {
+	loc := start.Location()
+	y, m, d := start.Date()
+	step := period * r.Interval
+
+	// Find the days making up the period.
+	var first, end time.Time
+	switch r.Freq {
+	case FreqDaily:
+		first = time.Date(y, m, d+step, 0, 0, 0, 0, loc)
+		end = first.AddDate(0, 0, 1)
+	case FreqWeekly:
+		monday := d - (int(start.Weekday())+6)%7
+		first = time.Date(y, m, monday+7*step, 0, 0, 0, 0, loc)
+		end = first.AddDate(0, 0, 7)
+	case FreqMonthly:
+		first = time.Date(y, m+time.Month(step), 1, 0, 0, 0, 0, loc)
+		end = first.AddDate(0, 1, 0)
+	case FreqYearly:
+		first = time.Date(y+step, time.January, 1, 0, 0, 0, 0, loc)
+		end = first.AddDate(1, 0, 0)
+	}
+
+	hour, min, sec := start.Clock()
+	var matched []time.Time
+	for day := first; day.Before(end); day = day.AddDate(0, 0, 1) {
+		if r.matches(day, start) {
+			matched = append(matched, time.Date(day.Year(), day.Month(),
+				day.Day(), hour, min, sec, 0, loc))
+		}
+	}
+	return r.setPos(matched)
+}
+
+// matches checks whether the day is selected by the BYDAY and
+// BYMONTHDAY parts of the rule. If neither is given, then the day must
+// fall in the same position in its period as start does.
+func (r *RRule) matches(day, start time.Time) bool {
+	if len(r.ByDay) == 0 && len(r.ByMonthDay) == 0 {
+		switch r.Freq {
+		case FreqWeekly:
+			return day.Weekday() == start.Weekday()
+		case FreqMonthly:
+			return day.Day() == start.Day()
+		case FreqYearly:
+			return day.Month() == start.Month() && day.Day() == start.Day()
+		}
+		return true
+	}
+
+	if len(r.ByMonthDay) > 0 {
+		// Negative days count back from the end of the month.
+		last := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0,
+			day.Location()).Day()
+		found := false
+		for _, n := range r.ByMonthDay {
+			if n == day.Day() || n == day.Day()-last-1 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.ByDay) > 0 {
+		// Positions only have meaning within months and years.
+		positional := r.Freq == FreqMonthly || r.Freq == FreqYearly
+		found := false
+		for _, rd := range r.ByDay {
+			if rd.Weekday == day.Weekday() && (rd.N == 0 || !positional ||
+				rd.N == r.position(day, rd.N < 0)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// position returns which occurrence of its weekday the day is within
+// its month, or its year for yearly rules. If fromEnd is set, it is
+// counted backward from the end, and negative.
+func (r *RRule) position(day time.Time, fromEnd bool) int {
+	index, length := day.Day(), time.Date(day.Year(), day.Month()+1, 0,
+		0, 0, 0, 0, day.Location()).Day()
+	if r.Freq == FreqYearly {
+		index = day.YearDay()
+		length = time.Date(day.Year(), time.December, 31, 0, 0, 0, 0,
+			day.Location()).YearDay()
+	}
+
+	if fromEnd {
+		return -((length-index)/7 + 1)
+	}
+	return (index-1)/7 + 1
+}
+
+// setPos narrows the occurrences in a period to those at the positions
+// in the BYSETPOS part of the rule, if there is one.
+func (r *RRule) setPos(occurrences []time.Time) []time.Time {
+	if len(r.BySetPos) == 0 {
+		return occurrences
+	}
+
+	var selected []time.Time
+	seen := make(map[int]bool)
+	for _, pos := range r.BySetPos {
+		i := pos - 1
+		if pos < 0 {
+			i = len(occurrences) + pos
+		}
+		if i >= 0 && i < len(occurrences) && !seen[i] {
+			seen[i] = true
+			selected = append(selected, occurrences[i])
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].Before(selected[j])
+	})
+	return selected
+}
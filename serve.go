@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultServeAddr is the address on which the serve command
+	// listens if none is given. It is only reachable from the local
+	// machine, because requests are not authenticated.
+	DefaultServeAddr = "127.0.0.1:8080"
+
+	// maxRequestBody is the largest request body which is read.
+	maxRequestBody = 1 << 20
+)
+
+var (
+	ErrNotSaved      = errors.New("could not save list")
+	ErrForeignHost   = errors.New("request is not for the address served")
+	ErrForeignOrigin = errors.New("request is from another origin")
+	ErrNotJSON       = errors.New("request must be application/json")
+)
+
+// taskRequest is the body of a request to add a task. Type selects
+// the command which adds it, and the remaining fields are given to it
+// as they would be on the command line, so that dates may be given in
+// any format understood by ParseDate, such as RFC 3339. Recurring
+// tasks are given a Delay, a Rule, or a delay After completion.
+type taskRequest struct {
+	Type        string   `json:"type"`
+	Name        string   `json:"name"`
+	Priority    int      `json:"priority"`
+	Description string   `json:"description"`
+	Due         string   `json:"due"`
+	Start       string   `json:"start"`
+	End         string   `json:"end"`
+	Delay       string   `json:"delay"`
+	After       string   `json:"after"`
+	Rule        string   `json:"rule"`
+	Backlog     string   `json:"backlog"`
+	Parent      string   `json:"parent"`
+	Project     string   `json:"project"`
+	Tags        []string `json:"tags"`
+	Depends     []string `json:"depends"`
+}
+
+// server answers HTTP requests by running commands on the Context,
+// one at a time, as they would be run in interactive mode.
+type server struct {
+	// mu serialises access to the Context, which is shared by every
+	// request.
+	mu  sync.Mutex
+	ctx *Context
+
+	// addr is the address being served.
+	addr string
+}
+
+func (c *Command) CmdServe(ctx *Context) (err error) {
+	glog.V(2).Infoln("User invoked serve")
+
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	addr := flags.String("addr", DefaultServeAddr, "")
+	if err = flags.Parse(c.Args); err != nil {
+		return err
+	}
+
+	// Requests are answered with Records, without prompting, and list
+	// every task. Anything else which would be written goes to the
+	// prompt, rather than into a response.
+	s := &server{ctx: ctx, addr: *addr}
+	format, interactive, maxItems := ctx.Format, ctx.Interactive,
+		ctx.MaxListItems
+	output, prompt := ctx.Output, ctx.Prompt
+	if prompt == nil {
+		ctx.Prompt = output
+	}
+	ctx.Format, ctx.Interactive, ctx.MaxListItems = FormatJSON, false, -1
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		ctx.Format, ctx.Interactive = format, interactive
+		ctx.MaxListItems = maxItems
+		ctx.Output, ctx.Prompt = output, prompt
+
+		// Each request has recorded its own changes in the journal,
+		// so serving is not recorded as a change of its own.
+		ctx.skipJournal = true
+	}()
+
+	// Like in interactive mode, the lock is only held while each
+	// request is answered, so that other processes may use the list
+	// in between.
+	ctx.Unlock()
+
+	writePrompt(ctx, "Serving %s on http://%s/tasks\n", ctx.loadpath, *addr)
+	glog.Infof("Serving %q on %s\n", ctx.loadpath, *addr)
+	return http.ListenAndServe(*addr, s)
+}
+
+// ServeHTTP routes requests for the list of tasks and for single tasks
+// to the commands which answer them.
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	glog.V(1).Infof("%s %s\n", r.Method, r.URL)
+	if status, err := s.check(r); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	path := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	if path[0] != "tasks" || len(path) > 3 ||
+		(len(path) == 3 && path[2] != "done") {
+		writeError(w, http.StatusNotFound, ErrNoMatch)
+		return
+	}
+	var id string
+	if len(path) > 1 {
+		var err error
+		if id, err = url.PathUnescape(path[1]); err != nil || id == "" {
+			writeError(w, http.StatusNotFound, ErrNoMatch)
+			return
+		}
+	}
+
+	switch {
+	case len(path) == 1 && r.Method == http.MethodGet:
+		filter := strings.Fields(r.FormValue("filter"))
+		s.run(w, http.StatusOK, append([]string{"list"}, filter...)...)
+	case len(path) == 1 && r.Method == http.MethodPost:
+		var req taskRequest
+		if err := readRequest(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		args, err := req.args()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		s.run(w, http.StatusCreated, args...)
+	case len(path) == 2 && r.Method == http.MethodGet:
+		s.run(w, http.StatusOK, "show", id)
+	case len(path) == 2 && r.Method == http.MethodPatch:
+		var fields map[string]interface{}
+		if err := readRequest(w, r, &fields); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		mods, err := modifyArgs(fields)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		s.run(w, http.StatusOK, append([]string{"modify", id}, mods...)...)
+	case len(path) == 3 && r.Method == http.MethodPost:
+		s.run(w, http.StatusOK, "done", id)
+	default:
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// check refuses requests which a web page could have had a browser
+// make, since requests are not otherwise authenticated. The Host must
+// be the address being served, so that a page can't have its own name
+// resolve to that address, any Origin must be the same, and requests
+// other than GET must be JSON, which pages can't send to other origins
+// without their permission.
+func (s *server) check(r *http.Request) (int, error) {
+	if !s.allowedHost(r.Host) {
+		return http.StatusForbidden, ErrForeignHost
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme != "http" || u.Host != r.Host {
+			return http.StatusForbidden, ErrForeignOrigin
+		}
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || t != "application/json" {
+			return http.StatusUnsupportedMediaType, ErrNotJSON
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// allowedHost checks whether the Host of a request is the address
+// being served. Other names could be made to resolve to it, so
+// besides the name it was given, only "localhost" and IP addresses
+// which reach it are allowed.
+func (s *server) allowedHost(host string) bool {
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = host, "80"
+	}
+	addrName, addrPort, err := net.SplitHostPort(s.addr)
+	if err != nil || port != addrPort {
+		return false
+	}
+	if strings.EqualFold(name, addrName) {
+		return true
+	}
+
+	local := strings.EqualFold(name, "localhost")
+	ip, addrIP := net.ParseIP(name), net.ParseIP(addrName)
+	switch {
+	case addrName == "" || addrIP != nil && addrIP.IsUnspecified():
+		return local || ip != nil
+	case strings.EqualFold(addrName, "localhost") ||
+		addrIP != nil && addrIP.IsLoopback():
+		return local || ip != nil && ip.IsLoopback()
+	}
+	return false
+}
+
+// run parses a Command from the arguments and runs it on the Context,
+// holding the lock on the list file and saving the list afterward, as
+// in interactive mode. The Records it produces, followed by those of
+// any errors, are the response, which has the given status if it
+// succeeds.
+func (s *server) run(w http.ResponseWriter, status int, args ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ctx := s.ctx
+	var out bytes.Buffer
+	ctx.Output = &out
+
+	var errs []error
+	if c, err := ParseCommand(args); err != nil {
+		status, errs = http.StatusBadRequest, []error{err}
+	} else {
+		status, errs = s.runCommand(c, status)
+	}
+	for _, err := range errs {
+		ctx.records = append(ctx.records, errorRecord(err))
+		glog.Warningf("Error in request: %s\n", err)
+	}
+	ctx.flushRecords()
+	writeJSON(w, status, out.Bytes())
+}
+
+// runCommand runs the Command on the Context, and returns the status
+// of the response and any errors. Its Records are left to be written
+// along with the errors. The Context must not be used by anything
+// else while it runs.
+func (s *server) runCommand(c *Command, status int) (int, []error) {
+	ctx := s.ctx
+	if err := ctx.Lock(); err != nil {
+		glog.Errorf("Could not lock list: %s\n", err)
+		return http.StatusInternalServerError, []error{err}
+	}
+	defer ctx.Unlock()
+	if err := ctx.Sync(); err != nil {
+		glog.Errorf("Could not reload list: %s\n", err)
+		return http.StatusInternalServerError, []error{err}
+	}
+
+	ctx.List = ctx.fileList.List()
+	err := journalCommand(c, ctx)
+	ctx.Save()
+
+	var errs []error
+	if err != nil {
+		status = errorStatus(err)
+		errs = append(errs, err)
+	}
+	if ctx.modified {
+		// The changes are kept, and saved along with those of the
+		// next request, but the client should know that they have
+		// not been yet.
+		if err == nil {
+			status = http.StatusInternalServerError
+		}
+		errs = append(errs, ErrNotSaved)
+	}
+	return status, errs
+}
+
+// errorStatus gives the status of the response to a request whose
+// command failed with the error.
+func errorStatus(err error) int {
+	if _, ok := err.(*AmbiguousError); ok {
+		return http.StatusConflict
+	}
+	switch err {
+	case ErrNoMatch, ErrNoTasks:
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+// args gives the arguments of the command which adds the task
+// described by the request.
+func (req *taskRequest) args() ([]string, error) {
+	if req.Name == "" {
+		return nil, ErrMissingName
+	}
+	if req.Priority == 0 {
+		return nil, ErrMissingPriority
+	}
+	args := []string{"", req.Name, strconv.Itoa(req.Priority)}
+
+	switch strings.ToLower(req.Type) {
+	case TypeDefinite, "":
+		args[0] = "add"
+		args = append(args, strings.Fields(req.Due)...)
+	case TypeEventual:
+		args[0] = "eventually"
+	case TypeRecurring:
+		args[0] = "recurring"
+		args = append(args, strings.Fields(req.Start)...)
+		if req.End != "" {
+			args = append(args, "until")
+			args = append(args, strings.Fields(req.End)...)
+		}
+		switch {
+		case req.Rule != "":
+			args = append(args, req.Rule)
+		case req.After != "":
+			args = append(args, AfterCompletionPrefix+req.After)
+		default:
+			args = append(args, req.Delay)
+		}
+		if req.Backlog != "" {
+			args = append(args, BacklogPrefix+req.Backlog)
+		}
+	default:
+		return nil, fmt.Errorf("unknown task type %q", req.Type)
+	}
+
+	if req.Parent != "" {
+		args = append(args, ParentPrefix+req.Parent)
+	}
+	if req.Project != "" {
+		args = append(args, ProjectPrefix+req.Project)
+	}
+	for _, tag := range req.Tags {
+		args = append(args, "+"+tag)
+	}
+	if len(req.Depends) > 0 {
+		args = append(args, DependsPrefix+strings.Join(req.Depends, ","))
+	}
+	if req.Description != "" {
+		args = append(args, "--", req.Description)
+	}
+	return args, nil
+}
+
+// modifyArgs gives the field=value arguments of the modify command
+// which makes the changes given by the fields of a request, in order
+// of their names. Lists, such as of tags, are separated by commas.
+func modifyArgs(fields map[string]interface{}) ([]string, error) {
+	var args []string
+	for field, value := range fields {
+		if field == "" || strings.IndexFunc(field, func(r rune) bool {
+			return !('a' <= r && r <= 'z')
+		}) >= 0 {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+
+		var s string
+		switch v := value.(type) {
+		case nil:
+		case []interface{}:
+			values := make([]string, len(v))
+			for i := range v {
+				values[i] = fmt.Sprint(v[i])
+			}
+			s = strings.Join(values, ",")
+		case map[string]interface{}:
+			return nil, fmt.Errorf("invalid field %q", field)
+		default:
+			s = fmt.Sprint(v)
+		}
+		args = append(args, field+"="+s)
+	}
+	if len(args) == 0 {
+		return nil, ErrNoFields
+	}
+	sort.Strings(args)
+	return args, nil
+}
+
+// readRequest decodes the JSON body of the request into v. Numbers are
+// kept as they were written.
+func readRequest(w http.ResponseWriter, r *http.Request,
+	v interface{}) error {
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	dec.UseNumber()
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// writeJSON writes a response with the given status and JSON body.
+func writeJSON(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		glog.Warningf("Could not write response: %s\n", err)
+	}
+}
+
+// writeError responds with an error Record, for requests which fail
+// before any command is run.
+func writeError(w http.ResponseWriter, status int, err error) {
+	glog.Warningf("Error in request: %s\n", err)
+	b, _ := json.MarshalIndent([]Record{errorRecord(err)}, "", "\t")
+	writeJSON(w, status, append(b, '\n'))
+}
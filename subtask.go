@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// ParentPrefix begins an argument which gives the task that a new
+	// task is a subtask of.
+	ParentPrefix = "parent:"
+
+	// SubtaskIndent is the indentation of each level of subtasks in
+	// the list view.
+	SubtaskIndent = "  "
+)
+
+// containers returns the TaskContainers stored directly in the
+// fileList, not including subtasks.
+func (fl *fileList) containers() (cs []TaskContainer) {
+	if fl == nil {
+		return nil
+	}
+	for _, t := range fl.Definite {
+		cs = append(cs, t)
+	}
+	for _, t := range fl.Eventual {
+		cs = append(cs, t)
+	}
+	for _, g := range fl.Recurring {
+		cs = append(cs, g)
+	}
+	return
+}
+
+// walk calls fn for every TaskContainer in the fileList, including
+// subtasks, along with the TaskContainer it is a subtask of, or nil.
+// Each is visited before its subtasks.
+func (fl *fileList) walk(fn func(c, parent TaskContainer)) {
+	var visit func(fl *fileList, parent TaskContainer)
+	visit = func(fl *fileList, parent TaskContainer) {
+		for _, c := range fl.containers() {
+			fn(c, parent)
+			visit(c.Children(), c)
+		}
+	}
+	visit(fl, nil)
+}
+
+// Empty reports whether the fileList holds no tasks. A nil fileList
+// is empty.
+func (fl *fileList) Empty() bool {
+	return len(fl.containers()) == 0
+}
+
+// Contains checks whether the TaskContainer is in the fileList,
+// including as a subtask.
+func (fl *fileList) Contains(c TaskContainer) (found bool) {
+	fl.walk(func(other, _ TaskContainer) {
+		found = found || other == c
+	})
+	return
+}
+
+// parentOf returns the TaskContainer which the given one is a subtask
+// of, or nil if it is not a subtask.
+func (fl *fileList) parentOf(c TaskContainer) (parent TaskContainer) {
+	fl.walk(func(other, p TaskContainer) {
+		if other == c {
+			parent = p
+		}
+	})
+	return
+}
+
+// container returns the TaskContainer with the given ID, including
+// subtasks, or nil if there is none.
+func (fl *fileList) container(id string) (c TaskContainer) {
+	if id == "" {
+		return nil
+	}
+	fl.walk(func(other, _ TaskContainer) {
+		if otherID, _ := other.(identity).identify(); *otherID == id {
+			c = other
+		}
+	})
+	return
+}
+
+// containerID returns the ID of a TaskContainer, or an empty string if
+// it is nil.
+func containerID(c TaskContainer) string {
+	if c == nil {
+		return ""
+	}
+	id, _ := c.(identity).identify()
+	return *id
+}
+
+// AddSubtask adds the TaskContainer to the fileList as a subtask of
+// the given parent, or directly if the parent is nil, and gives it an
+// ID.
+func (fl *fileList) AddSubtask(parent, c TaskContainer) {
+	if parent == nil {
+		fl.Add(c)
+		return
+	}
+	if parent.Children() == nil {
+		parent.SetChildren(&fileList{})
+	}
+	parent.Children().add(c)
+	fl.AssignIDs()
+}
+
+// extractParent removes a "parent:task" argument from the given
+// arguments, and finds the TaskContainer it identifies, or nil if
+// there is none. The alias of a recurring task identifies the
+// recurring task itself.
+func (ctx *Context) extractParent(args []string) (rest []string,
+	parent TaskContainer, err error) {
+
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, ParentPrefix) {
+			rest = append(rest, arg)
+			continue
+		}
+
+		task, err := ctx.List.Find(strings.TrimPrefix(arg, ParentPrefix))
+		if amb, ok := err.(*AmbiguousError); ok {
+			if tasks := ctx.List.sameContainer(amb); tasks != nil {
+				task, err = tasks[0], nil
+			}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		parent = containerOf(task)
+	}
+	return rest, parent, nil
+}
+
+// listBuilder gathers the Tasks of a fileList and its subtasks, so
+// that they can be sorted among their siblings and then nested.
+type listBuilder struct {
+	// all is every Task produced, in the order they were produced.
+	all List
+
+	// subtasks are the Tasks of the subtasks of each TaskContainer,
+	// by the Task which they are listed beneath.
+	subtasks map[Task]List
+
+	// completed is the number of archived subtasks of each
+	// TaskContainer, by its ID.
+	completed map[string]int
+}
+
+// tasks produces the Tasks of the TaskContainers in the fileList,
+// which are nested at the given depth, and recursively those of their
+// subtasks.
+func (b *listBuilder) tasks(fl *fileList, depth int) (l List) {
+	for _, c := range fl.containers() {
+		tasks := c.Tasks()
+		for _, t := range tasks {
+			t.Metadata().depth = depth
+		}
+		l = append(l, tasks...)
+		b.all = append(b.all, tasks...)
+
+		// Recurring tasks may have several Tasks listed at once, but
+		// subtasks are only listed beneath the earliest.
+		children := c.Children()
+		if len(tasks) == 0 {
+			continue
+		}
+		m := tasks[0].Metadata()
+		m.subtasksDone = b.completed[containerID(c)]
+		m.subtasks = m.subtasksDone + len(children.containers())
+		if !children.Empty() {
+			b.subtasks[tasks[0]] = b.tasks(children, depth+1)
+		}
+	}
+	return
+}
+
+// nest sorts the List, as fileList.List does, and follows each Task
+// with its own subtasks, sorted in turn.
+func (b *listBuilder) nest(l List) (nested List) {
+	l.Sort()
+	l.rankDependencies()
+	for _, t := range l {
+		nested = append(nested, t)
+		nested = append(nested, b.nest(b.subtasks[t])...)
+	}
+	return
+}
+
+// progressLabel annotates a task with the number of its subtasks which
+// have been completed, as in " (3/5)".
+func progressLabel(done, total int) string {
+	if total == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%d/%d)", done, total)
+}
+
+// completeSubtasks archives the remaining subtasks of a TaskContainer
+// which has been completed and removed, along with their own subtasks,
+// because they cannot be listed without it.
+func (fl *fileList) completeSubtasks(parent TaskContainer,
+	completed time.Time) {
+
+	for _, c := range parent.Children().containers() {
+		for _, t := range c.Tasks() {
+			fl.archive(t, parent, completed)
+			fl.unblock(t)
+		}
+		fl.completeSubtasks(c, completed)
+	}
+}
+
+// taskOf returns the first Task in the List which was produced by the
+// given TaskContainer, or nil if there is none.
+func (l List) taskOf(c TaskContainer) Task {
+	for _, t := range l {
+		if containerOf(t) == c {
+			return t
+		}
+	}
+	return nil
+}
@@ -3,13 +3,15 @@ package main
 import (
 	"fmt"
 	"github.com/SashaCrofter/reltime"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type Task interface {
 	// Nice is the integer value which determines how urgent the task
-	// is, with lower values meaning greater urgency.
+	// is, with lower values meaning greater urgency. It is calculated
+	// by the UrgencyModel of the global Context.
 	Nice() int
 
 	// Match checks whether a given search term should match the task,
@@ -28,17 +30,70 @@ type Task interface {
 	// Done is used to remove a Task from being displayed again after
 	// it has been marked completed by the user.
 	Done(*fileList)
+
+	// Info describes the Task uniformly, regardless of its kind.
+	Info() TaskInfo
+
+	// Metadata returns the task's Meta, which may be modified.
+	Metadata() *Meta
+}
+
+// TaskInfo is a description of a Task which is common to all kinds.
+type TaskInfo struct {
+	// Type is the kind of task, such as TypeDefinite.
+	Type string
+
+	// ID is the task's UUID, and Alias is a short number which can be
+	// used in its place. For instances of recurring tasks, they are
+	// those of the generator, followed by the occurrence number.
+	ID, Alias string
+
+	// Occurrence is the occurrence number of recurring tasks, or 0,
+	// and Missed is the number of missed tasks it stands for.
+	Occurrence, Missed int
+
+	// DueBy is zero for eventual tasks.
+	Priority          int
+	DueBy             time.Time
+	Name, Description string
+
+	Meta
+}
+
+// indentDescription formats a possibly multi-line description to be
+// shown beneath a task, with each line indented, or returns an empty
+// string if there is no description.
+func indentDescription(description string) string {
+	if description == "" {
+		return ""
+	}
+	return "\t" + strings.Replace(description, "\n", "\n\t", -1) + "\n"
 }
 
 type TaskContainer interface {
 	// Tasks returns a representation of the TaskContainer as a slice
 	// of Tasks, which may be nil.
 	Tasks() []Task
+
+	// Children returns the fileList holding the subtasks of the
+	// TaskContainer, which is nil if it has none, and SetChildren
+	// replaces it.
+	Children() *fileList
+	SetChildren(*fileList)
 }
 
 const (
-	// EventualFactor is the amount of time by which the priorities on
-	// eventual tasks are multiplied.
+	// TypeDefinite, TypeEventual, and TypeRecurring name the kinds of
+	// tasks, such as when they are archived.
+	TypeDefinite  = "definite"
+	TypeEventual  = "eventual"
+	TypeRecurring = "recurring"
+)
+
+const (
+	// EventualFactor is the default amount of time, in seconds, by
+	// which the priorities on eventual tasks are multiplied by the
+	// DefaultUrgency.
 	EventualFactor = time.Duration(time.Hour*168) / time.Second
 
 	// EventualThreshold is the about by which a priority value must
@@ -47,9 +102,20 @@ const (
 )
 
 type DefiniteTask struct {
+	// ID is a UUID which identifies the task permanently, and Alias
+	// is a short number which identifies it among current tasks.
+	ID    string `json:",omitempty"`
+	Alias int    `json:",omitempty"`
+
 	Priority          int
 	DueBy             time.Time
 	Name, Description string
+
+	Meta
+
+	// Subtasks are the tasks which belong to this one, and are listed
+	// beneath it.
+	Subtasks *fileList `json:",omitempty"`
 }
 
 // Tasks causes DefiniteTask to satisfy the TaskContainer interface.
@@ -57,14 +123,14 @@ func (t *DefiniteTask) Tasks() []Task {
 	return []Task{t}
 }
 
+func (t *DefiniteTask) Children() *fileList      { return t.Subtasks }
+func (t *DefiniteTask) SetChildren(fl *fileList) { t.Subtasks = fl }
+
 // Nice calculates the numerical nice value for a DefiniteTask, so
-// that it can be sorted easily. The formula is
-//
-//     priority * secondsin(due - now)
-//
-// where timestamps are UNIX dates.
+// that it can be sorted easily, using the UrgencyModel of the global
+// Context.
 func (t *DefiniteTask) Nice() int {
-	return t.Priority * int(t.DueBy.Sub(time.Now())/time.Second)
+	return urgency().Nice(t, Now())
 }
 
 // Match checks whether the given search term matches the task's title
@@ -81,8 +147,9 @@ func (t *DefiniteTask) String() string {
 	// Ctx.Colors is not set, then it will do nothing.
 	col := BrushConditionally(Ctx, ColorForDate(t.DueBy, ColorThreshold))
 
-	return fmt.Sprintf(col("(%d) %s - %s\n"),
-		t.Priority, reltime.FormatRelative(RelFmt, DueFmt, t.DueBy), t.Name)
+	return fmt.Sprintf(col("(%d) %s - %s%s\n"),
+		t.Priority, reltime.FormatRelative(RelFmt, DueFmt, t.DueBy), t.Name,
+		t.Labels())
 }
 
 // LongString allows Tasks to be stringified in full, including the
@@ -92,24 +159,43 @@ func (t *DefiniteTask) LongString() string {
 	// Ctx.Colors is not set, then it will do nothing.
 	col := BrushConditionally(Ctx, ColorForDate(t.DueBy, ColorThreshold))
 
-	return fmt.Sprintf(col("(%d) %s - %s\n\t%s\n"),
+	return fmt.Sprintf(col("(%d) %s - %s%s\n%s"),
 		t.Priority, reltime.FormatRelative(RelFmt, DueFmt, t.DueBy),
-		t.Name, t.Description)
+		t.Name, t.Labels(), indentDescription(t.Description))
 }
 
 func (t *DefiniteTask) Done(fl *fileList) {
-	for i, container := range fl.Definite {
-		if container == t {
-			fl.Definite = append(fl.Definite[:i], fl.Definite[i+1:]...)
-		}
+	fl.Remove(t)
+}
+
+func (t *DefiniteTask) Info() TaskInfo {
+	return TaskInfo{
+		Type:        TypeDefinite,
+		ID:          t.ID,
+		Alias:       strconv.Itoa(t.Alias),
+		Priority:    t.Priority,
+		DueBy:       t.DueBy,
+		Name:        t.Name,
+		Description: t.Description,
+		Meta:        t.Meta,
 	}
 }
 
 // EventualTask floats around in the todo list, remaining at a
 // constant Nice value.
 type EventualTask struct {
+	// ID and Alias identify the task, as for DefiniteTask.
+	ID    string `json:",omitempty"`
+	Alias int    `json:",omitempty"`
+
 	Priority          int
 	Name, Description string
+
+	Meta
+
+	// Subtasks are the tasks which belong to this one, as for
+	// DefiniteTask.
+	Subtasks *fileList `json:",omitempty"`
 }
 
 // Tasks causes EventualTask to satisfy the TaskContainer interface.
@@ -117,8 +203,11 @@ func (t *EventualTask) Tasks() []Task {
 	return []Task{t}
 }
 
+func (t *EventualTask) Children() *fileList      { return t.Subtasks }
+func (t *EventualTask) SetChildren(fl *fileList) { t.Subtasks = fl }
+
 func (t *EventualTask) Nice() int {
-	return t.Priority * int(EventualFactor)
+	return urgency().Nice(t, Now())
 }
 
 func (t *EventualTask) Match(term string) bool {
@@ -132,7 +221,8 @@ func (t *EventualTask) String() string {
 	col := BrushConditionally(Ctx,
 		ColorForPriority(t.Priority, EventualThreshold))
 
-	return fmt.Sprintf(col("(%d) - %s\n"), t.Priority, t.Name)
+	return fmt.Sprintf(col("(%d) - %s%s\n"), t.Priority, t.Name,
+		t.Labels())
 }
 
 func (t *EventualTask) LongString() string {
@@ -141,21 +231,35 @@ func (t *EventualTask) LongString() string {
 	col := BrushConditionally(Ctx,
 		ColorForPriority(t.Priority, EventualThreshold))
 
-	return fmt.Sprintf(col("(%d) - %s\n\t%s\n"),
-		t.Priority, t.Name, t.Description)
+	return fmt.Sprintf(col("(%d) - %s%s\n%s"),
+		t.Priority, t.Name, t.Labels(), indentDescription(t.Description))
 }
 
 func (t *EventualTask) Done(fl *fileList) {
-	for i, container := range fl.Eventual {
-		if container == t {
-			fl.Eventual = append(fl.Eventual[:i], fl.Eventual[i+1:]...)
-		}
+	fl.Remove(t)
+}
+
+func (t *EventualTask) Info() TaskInfo {
+	return TaskInfo{
+		Type:        TypeEventual,
+		ID:          t.ID,
+		Alias:       strconv.Itoa(t.Alias),
+		Priority:    t.Priority,
+		Name:        t.Name,
+		Description: t.Description,
+		Meta:        t.Meta,
 	}
 }
 
 // RecurringTaskGenerator is a generator tasks that occur at a regular
 // interval.
 type RecurringTaskGenerator struct {
+	// ID and Alias identify the generator, as for DefiniteTask. Its
+	// tasks are identified by these followed by their occurrence
+	// numbers.
+	ID    string `json:",omitempty"`
+	Alias int    `json:",omitempty"`
+
 	// LastCompleted marks the most recent task ID (1-indexed) to have
 	// been marked complete.
 	LastCompleted int
@@ -164,7 +268,27 @@ type RecurringTaskGenerator struct {
 	Except []int
 
 	Start, End time.Time
-	Delay      []time.Duration
+
+	// Delay is a cycle of intervals between tasks, starting at Start.
+	// If Rule is set, it is used instead, and tasks occur on the
+	// dates it describes, from Start onward.
+	Delay []time.Duration
+	Rule  *RRule `json:",omitempty"`
+
+	// AfterCompletion makes each task due one Delay after the previous
+	// one was completed, rather than after it was due, with only one
+	// task outstanding at a time. The first is due at Start.
+	// LastDone is the time at which the previous task was completed.
+	AfterCompletion bool `json:",omitempty"`
+	LastDone        time.Time
+
+	// Overrides replace the fields of individual occurrences, by
+	// their occurrence numbers, or skip them entirely.
+	Overrides map[int]*Override `json:",omitempty"`
+
+	// Backlog limits how many missed tasks are listed. If it is nil,
+	// they all are.
+	Backlog *BacklogPolicy `json:",omitempty"`
 
 	// Spawn is a template for the generated RecurringTask with its
 	// parent, occurrence counter, and due date unset. Its name and
@@ -172,42 +296,90 @@ type RecurringTaskGenerator struct {
 	// sprinted with the occurrence number (1-indexed) as the
 	// argument.
 	Spawn RecurringTask
+
+	// Subtasks are the tasks which belong to the recurring task as a
+	// whole. They are listed beneath its earliest outstanding task.
+	Subtasks *fileList `json:",omitempty"`
 }
 
+func (g *RecurringTaskGenerator) Children() *fileList      { return g.Subtasks }
+func (g *RecurringTaskGenerator) SetChildren(fl *fileList) { g.Subtasks = fl }
+
 // Tasks allows the RecurringTaskGenerator to produce all of its child
 // tasks based on stored parameters.
 func (g *RecurringTaskGenerator) Tasks() []Task {
-	// Find the last task ID that will be generated.
+	// Find the outstanding occurrences, and hide those which the
+	// Backlog policy leaves out.
+	now := Now()
+	shown, hidden := g.backlog(g.outstanding(now), now)
 
-	// If the current time is less than the End time, add one extra
-	// task for the one currently in session, as long as the session
-	// has actually started.
-	var finalID int
-	endTime := time.Now()
-	if !g.End.IsZero() && endTime.After(g.End) {
-		endTime = g.End
-	} else if !g.Start.After(endTime) {
-		finalID++
+	tasks := make([]Task, 0, len(shown))
+	for _, id := range shown {
+		tasks = append(tasks, g.SpawnTask(id))
+	}
+
+	// When collapsing the backlog, the latest missed task stands for
+	// the others, and is annotated with their number.
+	if g.Backlog != nil && g.Backlog.Mode == BacklogCollapse {
+		for i := len(tasks) - 1; i >= 0; i-- {
+			if t := tasks[i].(*RecurringTask); t.DueBy.Before(now) {
+				t.Missed = len(hidden)
+				break
+			}
+		}
 	}
 
-	// Find the number of instances of the delays that have happened
-	// by the time between g.Start and current time.
-	finalID += g.FindLastID(endTime)
+	return tasks
+}
 
-	tasks := make([]Task, 0, finalID-g.LastCompleted+len(g.Except))
+// outstanding returns the occurrence numbers of the tasks which have
+// not been completed or skipped, up to the one in session at the given
+// time.
+func (g *RecurringTaskGenerator) outstanding(now time.Time) []int {
+	// Tasks which recur after completion only have the next one
+	// outstanding.
+	if g.AfterCompletion {
+		if g.exhausted(g.LastCompleted + 1) {
+			return nil
+		}
+		return []int{g.LastCompleted + 1}
+	}
 
-	// Add all the exceptions.
-	for _, id := range g.Except {
-		tasks = append(tasks, g.SpawnTask(id))
+	// Find the last task ID that will be generated.
+	var finalID int
+	if g.Rule != nil {
+		// Include the next occurrence of the rule after those which
+		// have already happened, if there is one.
+		finalID = g.FindLastID(now)
+		if !g.exhausted(finalID + 1) {
+			finalID++
+		}
+	} else {
+		// If the current time is less than the End time, add one
+		// extra task for the one currently in session, as long as
+		// the session has actually started.
+		endTime := now
+		if !g.End.IsZero() && endTime.After(g.End) {
+			endTime = g.End
+		} else if !g.Start.After(endTime) {
+			finalID++
+		}
+
+		// Find the number of instances of the delays that have
+		// happened by the time between g.Start and current time.
+		finalID += g.FindLastID(endTime)
 	}
 
-	// Add every task since the latest one that's been marked
-	// completed.
+	// Add all the exceptions, and then every task since the latest
+	// one that's been marked completed, except for those which have
+	// been skipped.
+	ids := append([]int(nil), g.Except...)
 	for id := g.LastCompleted; id < finalID; id++ {
-		tasks = append(tasks, g.SpawnTask(id+1))
+		if !g.skipped(id + 1) {
+			ids = append(ids, id+1)
+		}
 	}
-
-	return tasks
+	return ids
 }
 
 func (g *RecurringTaskGenerator) SpawnTask(occurrence int) *RecurringTask {
@@ -220,8 +392,13 @@ func (g *RecurringTaskGenerator) SpawnTask(occurrence int) *RecurringTask {
 	newtask.DueBy = g.DueByID(occurrence)
 
 	// Sprintf the remaining fields.
-	newtask.Name = fmt.Sprintf(g.Spawn.Name, occurrence)
-	newtask.Description = fmt.Sprintf(g.Spawn.Description, occurrence)
+	newtask.Name = formatOccurrence(g.Spawn.Name, occurrence)
+	newtask.Description = formatOccurrence(g.Spawn.Description, occurrence)
+
+	// Apply any changes made to this occurrence alone.
+	if o := g.Overrides[occurrence]; o != nil {
+		o.apply(&newtask)
+	}
 
 	return &newtask
 }
@@ -230,6 +407,19 @@ func (g *RecurringTaskGenerator) DueByID(occurrence int) time.Time {
 	// Calculate the number of full turnovers of the delay schedule
 	// the occurence is at, as well as its progress into the current
 	// one.
+	if g.Rule != nil {
+		return g.Rule.Occurrence(g.Start, occurrence)
+	}
+
+	// Only the due date of the next task is known when recurring after
+	// completion.
+	if g.AfterCompletion {
+		if occurrence <= 1 || g.LastDone.IsZero() {
+			return g.Start
+		}
+		return g.LastDone.Add(g.Delay[(occurrence-2)%len(g.Delay)])
+	}
+
 	occurrence -= 1
 	if occurrence < 0 {
 		return time.Time{}
@@ -249,6 +439,14 @@ func (g *RecurringTaskGenerator) SumDelay(lastIndex int) time.Duration {
 }
 
 func (g *RecurringTaskGenerator) FindLastID(t time.Time) (id int) {
+	// Rules are counted directly, up to the End time.
+	if g.Rule != nil {
+		if !g.End.IsZero() && t.After(g.End) {
+			t = g.End
+		}
+		return g.Rule.CountBefore(g.Start, t)
+	}
+
 	// First, find the number of complete delay schedule rollovers
 	// there have been, and multiply that by the number of tasks in
 	// the schedule. We add one because it's 1-indexed.
@@ -280,13 +478,21 @@ func (g *RecurringTaskGenerator) FindLastID(t time.Time) (id int) {
 // Done modifies the state of the generator such that a Task with the
 // ID date will not be produced again.
 func (g *RecurringTaskGenerator) Done(id int, fl *fileList) {
+	// Record when the task was completed, so that the next one can be
+	// scheduled after it. Earlier missed tasks which the Backlog policy
+	// hides are dropped along with it.
+	g.LastDone = Now()
+	hidden := g.hiddenBefore(id, g.LastDone)
+
 	// In the simplest case, the id is greater than the last completed
 	// task, so the counter can simply be incremented.
 	if id > g.LastCompleted {
 		// For each ID inbetween the new ID and the last completed
 		// one, add it to the list of exceptions.
 		for i := g.LastCompleted + 1; i < id; i++ {
-			g.Except = append(g.Except, i)
+			if !g.skipped(i) {
+				g.Except = append(g.Except, i)
+			}
 		}
 		// Set the LastCompleted marker.
 		g.LastCompleted = id
@@ -302,23 +508,44 @@ func (g *RecurringTaskGenerator) Done(id int, fl *fileList) {
 		}
 	}
 
-	// If an End date is supplied, we need to check whether the
-	// generator should remove itself.
-	if !g.End.IsZero() {
-		// If the LastCompleted task is the last one, and there are no
-		// exceptions, then we can remove this generator.
-		if g.DueByID(g.LastCompleted+1).After(g.End) &&
-			len(g.Except) == 0 {
-			for i, container := range fl.Recurring {
-				if container == g {
-					fl.Recurring = append(fl.Recurring[:i],
-						fl.Recurring[i+1:]...)
-				}
-			}
-		}
+	g.dropExceptions(hidden)
+
+	// Skipped occurrences which immediately follow the LastCompleted
+	// one need not be produced either, and overrides are no longer
+	// needed for any which are done.
+	for !g.AfterCompletion && g.skipped(g.LastCompleted+1) {
+		g.LastCompleted++
+	}
+	g.pruneOverrides()
+
+	// If the LastCompleted task is the last one, because of the End
+	// date or the end of the Rule, and there are no exceptions, then
+	// we can remove this generator.
+	if g.exhausted(g.LastCompleted+1) && len(g.Except) == 0 {
+		fl.Remove(g)
 	}
 }
 
+// exhausted checks whether the given occurrence is beyond the last one
+// the generator produces, either because it is after the End date, or
+// because the Rule has ended.
+func (g *RecurringTaskGenerator) exhausted(occurrence int) bool {
+	due := g.DueByID(occurrence)
+	if g.Rule != nil && due.IsZero() {
+		return true
+	}
+	return !g.End.IsZero() && due.After(g.End)
+}
+
+// formatOccurrence formats a field of a spawned task with its
+// occurrence number, if the field is a printf format string.
+func formatOccurrence(format string, occurrence int) string {
+	if !strings.Contains(format, "%") {
+		return format
+	}
+	return fmt.Sprintf(format, occurrence)
+}
+
 type RecurringTask struct {
 	// parent is a pointer to the RecurringTaskGenerator that
 	// generated this task.
@@ -327,13 +554,19 @@ type RecurringTask struct {
 	// Occurrence is the 1-indexed occurrence number of this task.
 	Occurrence int `json:"-"`
 
+	// Missed is the number of earlier missed tasks which this one
+	// stands for, when the generator collapses its backlog.
+	Missed int `json:"-"`
+
 	Priority          int
 	DueBy             time.Time `json:"-"`
 	Name, Description string
+
+	Meta
 }
 
 func (t *RecurringTask) Nice() int {
-	return t.Priority * int(t.DueBy.Sub(time.Now())/time.Second)
+	return urgency().Nice(t, Now())
 }
 
 // Match checks whether the given search term matches the task's title
@@ -348,8 +581,9 @@ func (t *RecurringTask) String() string {
 	// Ctx.Colors is not set, then it will do nothing.
 	col := BrushConditionally(Ctx, ColorForDate(t.DueBy, ColorThreshold))
 
-	return fmt.Sprintf(col("(%d) %s - %s\n"), t.Priority,
-		reltime.FormatRelative(RelFmt, DueFmt, t.DueBy), t.Name)
+	return fmt.Sprintf(col("(%d) %s - %s%s%s\n"), t.Priority,
+		reltime.FormatRelative(RelFmt, DueFmt, t.DueBy), t.Name,
+		missedLabel(t.Missed), t.Labels())
 }
 
 func (t *RecurringTask) LongString() string {
@@ -357,11 +591,27 @@ func (t *RecurringTask) LongString() string {
 	// Ctx.Colors is not set, then it will do nothing.
 	col := BrushConditionally(Ctx, ColorForDate(t.DueBy, ColorThreshold))
 
-	return fmt.Sprintf(col("(%d) %s - %s\n\t%s\n"),
+	return fmt.Sprintf(col("(%d) %s - %s%s%s\n%s"),
 		t.Priority, reltime.FormatRelative(RelFmt, DueFmt, t.DueBy),
-		t.Name, t.Description)
+		t.Name, missedLabel(t.Missed), t.Labels(),
+		indentDescription(t.Description))
 }
 
 func (t *RecurringTask) Done(fl *fileList) {
 	t.parent.Done(t.Occurrence, fl)
 }
+
+func (t *RecurringTask) Info() TaskInfo {
+	return TaskInfo{
+		Type:        TypeRecurring,
+		ID:          fmt.Sprintf("%s:%d", t.parent.ID, t.Occurrence),
+		Alias:       fmt.Sprintf("%d.%d", t.parent.Alias, t.Occurrence),
+		Occurrence:  t.Occurrence,
+		Missed:      t.Missed,
+		Priority:    t.Priority,
+		DueBy:       t.DueBy,
+		Name:        t.Name,
+		Description: t.Description,
+		Meta:        t.Meta,
+	}
+}
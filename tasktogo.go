@@ -8,6 +8,8 @@ import (
 	"io"
 	"os"
 	"path"
+	"text/template"
+	"time"
 )
 
 var (
@@ -17,13 +19,34 @@ var (
 	Ctx *Context
 )
 
+// ConflictSuffix is appended to the path of a list to form the path
+// at which unsaved changes are kept, if they conflict with those made
+// to the list by another process.
+const ConflictSuffix = ".conflict"
+
 // Flags
 var (
 	FlagColor   = flag.Bool("color", true, "enable list colorization")
 	FlagMaxList = flag.Int("n", 10, "max items to be shown in list view")
+	FlagBackups = flag.Int("backups", 3,
+		"number of backup generations to keep")
+	FlagHideBlocked = flag.Bool("hide-blocked", false,
+		"hide tasks blocked by others in list view")
+	FlagCompleteParents = flag.Bool("complete-parents", false,
+		"complete tasks when their last subtask is completed")
 
 	FlagList = flag.String("l", path.Join("$HOME", ".tasktogo"),
 		"select task list")
+	FlagConfig = flag.String("config", path.Join("$HOME", ".tasktogorc"),
+		"select configuration file")
+	FlagUrgency = flag.String("urgency", "",
+		"select urgency model (default or weighted)")
+	FlagFormat = flag.String("format", FormatText,
+		"select output format (text, json, or ndjson)")
+	FlagTemplate = flag.String("template", "",
+		"select template for list view")
+	FlagNow = flag.String("now", "",
+		"run as though it were the given time")
 )
 
 type Context struct {
@@ -48,10 +71,49 @@ type Context struct {
 	// displayed at once.
 	MaxListItems int
 
+	// Interactive is a flag which implies that commands are being
+	// read from the Input, so that the user can be prompted for more.
+	Interactive bool
+
 	// Colors is a flag which determines whether tasks should colorize
 	// themselves according to due date when using String().
 	Colors bool
 
+	// HideBlocked is a flag which determines whether tasks blocked by
+	// others are left out of the list view.
+	HideBlocked bool
+
+	// CompleteParents is a flag which determines whether completing
+	// the last subtask of a task completes that task as well.
+	CompleteParents bool
+
+	// Backups is the number of backup generations of the list file
+	// to keep when saving.
+	Backups int
+
+	// Config holds the settings read from the configuration file.
+	Config Config
+
+	// Urgency is the UrgencyModel used to calculate the nice values
+	// of tasks.
+	Urgency UrgencyModel
+
+	// Format is the output format, such as FormatJSON. In structured
+	// formats, commands produce Records rather than text.
+	Format string
+
+	// ListTemplate renders each task in the list view. If it is nil,
+	// the DefaultTemplate is used.
+	ListTemplate *template.Template
+
+	// Clock tells the time at which commands are run. If it is nil,
+	// the actual time is used.
+	Clock Clock
+
+	// records are the Records produced by the current command, which
+	// are written once it finishes.
+	records []Record
+
 	// loadpath is the path on the filesystem from which the List was
 	// loaded.
 	loadpath string
@@ -63,29 +125,262 @@ type Context struct {
 	// newlist is a flag which implies that the fileList does not yet
 	// exist on the filesystem.
 	newlist bool
+
+	// saved is the fileList as it was when it was last loaded or
+	// saved, so that unsaved changes can be made again to the list
+	// once another process has changed it.
+	saved sections
+
+	// loadinfo describes the list file as it was when it was last
+	// loaded or saved, so that changes made by other processes can be
+	// detected. It is nil if the file did not exist.
+	loadinfo os.FileInfo
+
+	// lock is the advisory lock on the list file, if it is held.
+	lock *fileLock
+
+	// journal records the changes made by each command, so that they
+	// can be undone. It is loaded and saved along with the fileList.
+	journal *Journal
+
+	// journalModified is a flag which implies that the journal should
+	// be saved along with the fileList.
+	journalModified bool
+
+	// before is the fileList as it was before the current command
+	// ran, against which the changes it makes are recorded in the
+	// journal.
+	before sections
+
+	// skipJournal is set by commands which should not have their
+	// changes recorded in the journal, such as undo.
+	skipJournal bool
+}
+
+// Lock acquires the lock on the list file, blocking until it is
+// available. It should be held from before the list is read until
+// after it is saved. If the lock is already held, it does nothing.
+func (ctx *Context) Lock() error {
+	if ctx.lock != nil {
+		return nil
+	}
+	lock, err := LockFile(ctx.loadpath)
+	if err != nil {
+		return err
+	}
+	ctx.lock = lock
+	return nil
+}
+
+// Unlock releases the lock on the list file, if it is held.
+func (ctx *Context) Unlock() {
+	if ctx.lock == nil {
+		return
+	}
+	if err := ctx.lock.Unlock(); err != nil {
+		glog.Errorf("Could not unlock list: %s\n", err)
+	}
+	ctx.lock = nil
+}
+
+// Load reads the list file into the Context, replacing the fileList
+// and discarding any unsaved changes. If the file cannot be read, the
+// Context is left as it was.
+func (ctx *Context) Load() error {
+	info, _ := os.Stat(ctx.loadpath)
+	fl, isNew, err := ReadListFile(ctx.loadpath)
+	if err != nil {
+		return err
+	}
+
+	ctx.fileList, ctx.newlist = fl, isNew
+	ctx.loadinfo = info
+	ctx.saved, _ = fl.sections()
+
+	// Lists written before tasks had IDs need to have them assigned,
+	// and saved so that they remain the same.
+	ctx.modified = ctx.fileList.AssignIDs()
+
+	// A journal which can't be read shouldn't prevent the list from
+	// being used, so start a new one instead.
+	ctx.journal, err = ReadJournalFile(ctx.loadpath + JournalSuffix)
+	if err != nil {
+		glog.Errorf("Could not read journal, starting anew: %s\n", err)
+		ctx.journal = &Journal{}
+	}
+	ctx.journalModified = false
+	return nil
+}
+
+// Sync reloads the list file if it has been changed on disk by
+// another process since it was last loaded or saved. If there are
+// unsaved changes in memory, they are made again to the list as it is
+// now, so that neither process's changes are lost.
+func (ctx *Context) Sync() error {
+	info, _ := os.Stat(ctx.loadpath)
+	if !changedOnDisk(ctx.loadinfo, info) {
+		return nil
+	}
+
+	if ctx.modified {
+		glog.Warningf("List %q changed on disk, but there are "+
+			"unsaved changes\n", ctx.loadpath)
+		return ctx.merge()
+	}
+
+	glog.V(1).Infof("List %q changed on disk, reloading\n", ctx.loadpath)
+	return ctx.Load()
+}
+
+// merge reloads the list file, and makes the unsaved changes to the
+// list in memory again, recording them in the journal as a single
+// entry. If they conflict with the changes made on disk, such as by
+// both changing the same task, the list in memory is written beside
+// the list file instead, with the ConflictSuffix, and the list file is
+// used as it is.
+func (ctx *Context) merge() error {
+	unsaved := ctx.fileList
+	current, err := unsaved.sections()
+	if err != nil {
+		return err
+	}
+	changes := ctx.saved.Diff(current)
+	if err = ctx.Load(); err != nil {
+		return err
+	}
+
+	err = applyEntry(&ctx.fileList, &JournalEntry{Changes: changes}, false)
+	if err == nil {
+		ctx.journal.Record(&JournalEntry{
+			Time:    ctx.Now(),
+			Command: "(unsaved changes)",
+			Changes: changes,
+		})
+		ctx.modified = true
+		ctx.journalModified = true
+		glog.V(1).Infof("Merged unsaved changes into %q\n", ctx.loadpath)
+		return nil
+	}
+
+	path := ctx.loadpath + ConflictSuffix
+	if err = unsaved.WriteFile(path); err != nil {
+		return fmt.Errorf("could not keep unsaved changes: %s", err)
+	}
+	glog.Warningf("Unsaved changes conflict with list %q, kept in %q\n",
+		ctx.loadpath, path)
+	writePrompt(ctx, "Warning: list changed on disk; unsaved changes "+
+		"conflict, and were kept in %s\n", path)
+	return nil
+}
+
+// await runs fn, which waits for the user, such as by prompting for a
+// description or running an editor, without holding the lock on the
+// list file, so that other processes aren't kept waiting. The lock is
+// then taken again, and changes made to the list in the meantime are
+// picked up. It must be called before the command changes the list,
+// and anything the command found in the list before must be found
+// again afterward.
+func (ctx *Context) await(fn func() error) error {
+	if ctx.lock == nil {
+		return fn()
+	}
+	ctx.Unlock()
+	err := fn()
+	if lockErr := ctx.Lock(); lockErr != nil {
+		return lockErr
+	}
+	if syncErr := ctx.Sync(); syncErr != nil {
+		return syncErr
+	}
+
+	// Whatever was picked up was not changed by the command, so it
+	// isn't recorded as part of it.
+	ctx.List = ctx.fileList.List()
+	if before, sectionsErr := ctx.fileList.sections(); sectionsErr == nil {
+		ctx.before = before
+	}
+	return err
+}
+
+// changedOnDisk compares two descriptions of the list file, either of
+// which may be nil if it did not exist, and returns true if they
+// differ.
+func changedOnDisk(old, new os.FileInfo) bool {
+	if old == nil || new == nil {
+		return old != new
+	}
+	return !os.SameFile(old, new) || !old.ModTime().Equal(new.ModTime()) ||
+		old.Size() != new.Size()
 }
 
 func (ctx *Context) Save() {
 	// Only attempt to save if the fileList has been modified.
 	if ctx.modified {
-		err := ctx.fileList.WriteFile(ctx.loadpath)
+		// If the lock isn't already held, such as when exiting
+		// interactive mode, hold it while saving.
+		if ctx.lock == nil {
+			if err := ctx.Lock(); err != nil {
+				glog.Errorf("Could not lock list: %s\n", err)
+				return
+			}
+			defer ctx.Unlock()
+		}
+
+		// Keep a copy of the list as it was before these changes. If
+		// this fails, the list is still saved, because the change
+		// would otherwise be lost entirely.
+		err := RotateBackups(ctx.loadpath, ctx.Backups)
+		if err != nil {
+			glog.Errorf("Could not back up list: %s\n", err)
+		}
+
+		err = ctx.fileList.WriteFile(ctx.loadpath)
 		if err != nil {
 			glog.Errorf("Could not save list: %s\n", err)
 		} else {
 			glog.V(1).Infof("List saved to %q\n", ctx.loadpath)
+			ctx.modified = false
+			ctx.newlist = false
+			ctx.loadinfo, _ = os.Stat(ctx.loadpath)
+			ctx.saved, _ = ctx.fileList.sections()
+		}
+
+		// Only save the journal if the list itself was saved, so that
+		// it never records changes the list doesn't have.
+		if err == nil && ctx.journalModified {
+			err = ctx.journal.WriteFile(ctx.loadpath + JournalSuffix)
+			if err != nil {
+				glog.Errorf("Could not save journal: %s\n", err)
+			} else {
+				ctx.journalModified = false
+			}
 		}
 	}
 }
 
 // exit performs cleanup tasks and exits with the given status code.
 func exit(status int) {
-	// Save the global context if necessary.
+	// Save the global context if necessary, and release the lock if
+	// it is still held.
 	Ctx.Save()
+	Ctx.Unlock()
 
 	glog.Flush()
 	os.Exit(status)
 }
 
+// startupWarning reports a problem found while starting, which does
+// not prevent commands from being run. In structured formats, it is
+// written as a warning Record along with those of the first command.
+func startupWarning(ctx *Context, format string, a ...interface{}) {
+	glog.Errorf(format, a...)
+	if ctx.Structured() {
+		ctx.warn(format, a...)
+	} else {
+		writePrompt(ctx, format, a...)
+	}
+}
+
 func main() {
 	// Parse and command line flags.
 	flag.Parse()
@@ -97,22 +392,97 @@ func main() {
 
 		Colors:       *FlagColor,
 		MaxListItems: *FlagMaxList,
+		Backups:      *FlagBackups,
+		HideBlocked:  *FlagHideBlocked,
+
+		CompleteParents: *FlagCompleteParents,
+
+		journal: &Journal{},
 	}
 
-	// Attempt to load the given task list.
-	var err error
-	Ctx.loadpath = os.ExpandEnv(*FlagList)
-	Ctx.fileList, Ctx.newlist, err = ReadListFile(Ctx.loadpath)
+	format, err := ParseFormat(*FlagFormat)
+	if err != nil {
+		writePrompt(Ctx, "Error: %s\n", err)
+		glog.Errorf("Invalid output format: %s\n", err)
+		exit(2)
+	}
+	Ctx.Format = format
+
+	// If a time is given, stop the clock there, so that every command
+	// runs as though it were that time. Running at the actual time
+	// instead could record the wrong dates, so an invalid time is
+	// fatal.
+	if *FlagNow != "" {
+		now, err := ParseDate(*FlagNow, time.Now())
+		if err != nil {
+			glog.Errorf("Invalid time for -now: %s\n", err)
+			reportError(Ctx, fmt.Errorf("invalid time for -now: %s", err))
+			exit(2)
+		}
+		Ctx.Clock = FixedClock(now)
+	}
+
+	// Read the configuration, and select the urgency model it
+	// describes, unless another is given by flag. If either can't be
+	// used, the defaults are.
+	Ctx.Config, err = ReadConfigFile(os.ExpandEnv(*FlagConfig))
 	if err != nil {
-		msg := fmt.Sprintf("Could not read task list: %s\n", err)
-		glog.Error(msg)
-		writePrompt(Ctx, msg)
+		startupWarning(Ctx, "Could not read configuration: %s\n", err)
+	}
+	if *FlagUrgency != "" {
+		Ctx.Config["urgency"] = *FlagUrgency
+	}
+	Ctx.Urgency, err = NewUrgencyModel(Ctx.Config)
+	if err != nil {
+		startupWarning(Ctx, "Could not configure urgency: %s\n", err)
+		Ctx.Urgency = nil
+	}
+
+	// Likewise, use the list template given by flag or configuration,
+	// if it can be parsed.
+	text := *FlagTemplate
+	if text == "" {
+		text = Ctx.Config.String("list.template", "")
+	}
+	if text != "" {
+		Ctx.ListTemplate, err = ParseListTemplate(text)
+		if err != nil {
+			startupWarning(Ctx, "Could not parse list template: %s\n", err)
+			Ctx.ListTemplate = nil
+		}
+	}
+
+	// Lock and attempt to load the given task list. In command mode,
+	// the lock is held until exiting, so that no other process can
+	// change the list in between. In interactive mode, it is only
+	// held while each command runs. Without the lock, changes could
+	// overwrite those of another process, so failing to take it is
+	// fatal.
+	Ctx.loadpath = os.ExpandEnv(*FlagList)
+	if err := Ctx.Lock(); err != nil {
+		glog.Errorf("Could not lock task list: %s\n", err)
+		reportError(Ctx, fmt.Errorf("could not lock task list: %s", err))
+		exit(1)
+	}
+	if err := Ctx.Load(); err == ErrListNotJSON || err == ErrListNotTodoTxt {
+		// Saving the list would replace it with one in the other
+		// format, holding only the tasks added since.
+		glog.Errorf("Could not read task list: %s\n", err)
+		reportError(Ctx, fmt.Errorf("could not read task list: %s", err))
+		exit(1)
+	} else if err != nil {
+		startupWarning(Ctx, "Could not read task list: %s\n", err)
+	}
+	for _, u := range Ctx.fileList.unread {
+		startupWarning(Ctx, "Could not read line %d of task list, "+
+			"keeping it as it is: %s\n", u.n, u.err)
 	}
 
 	// If there are arguments, run in command mode.
 	if flag.NArg() > 0 {
 		exit(runCommandMode(Ctx))
 	} else {
+		Ctx.Unlock()
 		exit(runInteractiveMode(Ctx))
 	}
 }
@@ -127,18 +497,15 @@ func runCommandMode(ctx *Context) int {
 	c, err := ParseCommand(flag.Args())
 	if err != nil {
 		// If the command was invalid, log it and return 1.
-		writePrompt(ctx, "Error: %s\n", err)
+		reportError(ctx, err)
 		glog.Warningf("User error: %s\n", err)
 		return 1
 	}
 
-	// Re-generate the List.
-	ctx.List = ctx.fileList.List()
-
 	// Run the command.
-	err = c.Run(c, ctx)
+	err = runCommand(ctx, c)
 	if err != nil {
-		writePrompt(ctx, "Error: %s\n", err)
+		reportError(ctx, err)
 		glog.Warningf("Error in command: %s\n", err)
 		return 1
 	}
@@ -151,6 +518,11 @@ func runCommandMode(ctx *Context) int {
 // commands from the Context.Input and calling Run on them. It returns
 // the value with which the program should exit.
 func runInteractiveMode(ctx *Context) int {
+	ctx.Interactive = true
+
+	// Warnings from starting are written before the first prompt,
+	// rather than along with the first command.
+	ctx.flushRecords()
 	for {
 		// Print the prompt once, and get any errors.
 		c, err := Prompt(ctx)
@@ -178,18 +550,47 @@ func runInteractiveMode(ctx *Context) int {
 			// If the error was user-related, as implied by c not
 			// being nil, log and output the error, and start from the
 			// beginning of the loop.
-			writePrompt(ctx, "Error: %s\n", err)
+			reportError(ctx, err)
 			glog.Warningf("User error: %s\n", err)
 			continue
 		}
 
-		// Re-generate the List.
-		ctx.List = ctx.fileList.List()
+		// Hold the lock while the command runs, and pick up any
+		// changes made by other processes since the last command
+		// before running it. Save immediately afterward, so that the
+		// changes are visible to them in turn.
+		if err = ctx.Lock(); err != nil {
+			reportError(ctx, err)
+			glog.Errorf("Could not lock list: %s\n", err)
+			continue
+		}
+		if err = ctx.Sync(); err != nil {
+			reportError(ctx, err)
+			glog.Errorf("Could not reload list: %s\n", err)
+			ctx.Unlock()
+			continue
+		}
 
-		err = c.Run(c, ctx)
+		err = runCommand(ctx, c)
 		if err != nil {
-			writePrompt(ctx, "Error: %s\n", err)
+			reportError(ctx, err)
 			glog.Warningf("Error in command: %s\n", err)
 		}
+
+		ctx.Save()
+		ctx.Unlock()
+	}
+}
+
+// runCommand re-generates the List and runs the given Command on it,
+// recording any changes it makes in the journal. If it succeeds, any
+// Records it produced are written, following any warnings from before
+// it ran. Otherwise, they are left to be written along with the error.
+func runCommand(ctx *Context, c *Command) error {
+	ctx.List = ctx.fileList.List()
+	err := journalCommand(c, ctx)
+	if err == nil {
+		ctx.flushRecords()
 	}
+	return err
 }
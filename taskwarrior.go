@@ -0,0 +1,827 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// TaskwarriorTimeFormat is the format of times in Taskwarrior's
+	// JSON, which are in UTC.
+	TaskwarriorTimeFormat = "20060102T150405Z"
+
+	// twPending, twCompleted, twDeleted, and twRecurring are the
+	// statuses of Taskwarrior tasks. Recurring tasks are templates, from
+	// which pending tasks are produced with a parent. Waiting tasks are
+	// taken to be pending.
+	twPending   = "pending"
+	twCompleted = "completed"
+	twDeleted   = "deleted"
+	twRecurring = "recurring"
+
+	// twMaskDone, twMaskDeleted, and twMaskPending are the characters
+	// of the mask of a recurring task, by which Taskwarrior records
+	// what has become of each of its tasks.
+	twMaskDone    = '+'
+	twMaskDeleted = 'X'
+	twMaskPending = '-'
+)
+
+// TaskwarriorPriorities are the priorities given to tasks with
+// Taskwarrior's priorities. Tasks without one are given the
+// DefaultPriority. Priorities 3 and 4 are exported as low, and greater
+// ones as none.
+var TaskwarriorPriorities = map[string]int{"H": 1, "M": 2, "L": 3}
+
+// twTask is a task as Taskwarrior represents it in JSON. Taskwarrior
+// keeps attributes it does not know, so Tasktogo holds the task as it
+// is stored by tasktogo, and TasktogoParent the ID of the task it is a
+// subtask of, so that they can be imported again without losing what
+// Taskwarrior does not have.
+type twTask struct {
+	UUID        string         `json:"uuid"`
+	Status      string         `json:"status"`
+	Description string         `json:"description"`
+	Entry       string         `json:"entry,omitempty"`
+	Modified    string         `json:"modified,omitempty"`
+	End         string         `json:"end,omitempty"`
+	Due         string         `json:"due,omitempty"`
+	Until       string         `json:"until,omitempty"`
+	Priority    string         `json:"priority,omitempty"`
+	Project     string         `json:"project,omitempty"`
+	Tags        []string       `json:"tags,omitempty"`
+	Depends     twDepends      `json:"depends,omitempty"`
+	Annotations []twAnnotation `json:"annotations,omitempty"`
+
+	Recur  string      `json:"recur,omitempty"`
+	Mask   string      `json:"mask,omitempty"`
+	Parent string      `json:"parent,omitempty"`
+	IMask  json.Number `json:"imask,omitempty"`
+
+	Tasktogo       string `json:"tasktogo,omitempty"`
+	TasktogoParent string `json:"tasktogo_parent,omitempty"`
+}
+
+// twAnnotation is a note attached to a Taskwarrior task. The lines of
+// a task's description are its annotations.
+type twAnnotation struct {
+	Entry       string `json:"entry"`
+	Description string `json:"description"`
+}
+
+// twDepends are the UUIDs of the tasks a Taskwarrior task depends on.
+// They are written as a list, but older versions of Taskwarrior give
+// them separated by commas.
+type twDepends []string
+
+func (d *twDepends) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return json.Unmarshal(b, (*[]string)(d))
+	}
+	*d = strings.FieldsFunc(s, isTagSeparator)
+	return nil
+}
+
+// ExportTaskwarrior writes the tasks of the Context as JSON which
+// Taskwarrior's "task import" accepts. Subtasks are written as other
+// tasks, and completed tasks as completed ones. Recurring tasks become
+// a template, with a pending task for each of their listed tasks.
+func ExportTaskwarrior(ctx *Context, w io.Writer) error {
+	fl := &ctx.fileList
+	var tasks []*twTask
+	fl.walk(func(c, parent TaskContainer) {
+		t := newTWTask(c)
+		t.TasktogoParent = containerID(parent)
+		tasks = append(tasks, t)
+		if g, ok := c.(*RecurringTaskGenerator); ok {
+			tasks = append(tasks, g.twTasks(t)...)
+		}
+	})
+	for _, a := range fl.Archive {
+		tasks = append(tasks, newTWArchived(a))
+	}
+
+	// Like "task export", each task is written on its own line.
+	modified := twTime(ctx.Now())
+	var b bytes.Buffer
+	b.WriteString("[\n")
+	for i, t := range tasks {
+		t.Modified = modified
+		line, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		b.Write(line)
+		if i < len(tasks)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("]\n")
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// newTWTask describes the TaskContainer as a Taskwarrior task, which
+// is a template if it is a recurring task.
+func newTWTask(c TaskContainer) *twTask {
+	name, description, priority := commonFields(c)
+	m := metaOf(c)
+	t := &twTask{
+		UUID:        containerID(c),
+		Status:      twPending,
+		Description: *name,
+		Entry:       twTime(m.Created),
+		Priority:    twPriority(*priority),
+		Project:     m.Project,
+		Tags:        m.Tags,
+		Depends:     m.Depends,
+		Annotations: twAnnotations(*description, m.Created),
+		Tasktogo:    storedJSON(c),
+	}
+
+	switch c := c.(type) {
+	case *DefiniteTask:
+		t.Due = twTime(c.DueBy)
+	case *RecurringTaskGenerator:
+		t.Status = twRecurring
+		t.Recur, _ = c.twRecur()
+		t.Due = twTime(c.DueByID(1))
+		t.Until = twTime(c.End)
+	}
+	return t
+}
+
+// twTasks produces a Taskwarrior task for each of the listed tasks of
+// the recurring task, and records them in the mask of its template,
+// along with those which are done or skipped.
+func (g *RecurringTaskGenerator) twTasks(template *twTask) (tasks []*twTask) {
+	last := g.LastCompleted
+	for _, task := range g.Tasks() {
+		info := task.Info()
+		t := &twTask{
+			UUID:        twUUID(info.ID),
+			Status:      twPending,
+			Description: info.Name,
+			Entry:       twTime(info.Created),
+			Due:         twTime(info.DueBy),
+			Priority:    twPriority(info.Priority),
+			Project:     info.Project,
+			Tags:        info.Tags,
+			Depends:     info.Depends,
+			Annotations: twAnnotations(info.Description, info.Created),
+			Recur:       template.Recur,
+			Parent:      g.ID,
+			IMask:       json.Number(strconv.Itoa(info.Occurrence - 1)),
+		}
+		tasks = append(tasks, t)
+		if info.Occurrence > last {
+			last = info.Occurrence
+		}
+	}
+
+	mask := make([]byte, last)
+	for n := 1; n <= last; n++ {
+		switch {
+		case g.skipped(n):
+			mask[n-1] = twMaskDeleted
+		case g.finished(n):
+			mask[n-1] = twMaskDone
+		default:
+			mask[n-1] = twMaskPending
+		}
+	}
+	template.Mask = string(mask)
+	return
+}
+
+// newTWArchived describes the record of a completed task as a
+// completed Taskwarrior task.
+func newTWArchived(a *ArchivedTask) *twTask {
+	b, _ := json.Marshal(a)
+	return &twTask{
+		UUID:        archivedUUID(a),
+		Status:      twCompleted,
+		Description: a.Name,
+		Entry:       twTime(a.Created),
+		End:         twTime(a.Completed),
+		Due:         twTime(a.DueBy),
+		Priority:    twPriority(a.Priority),
+		Project:     a.Project,
+		Tags:        a.Tags,
+		Depends:     a.Depends,
+		Annotations: twAnnotations(a.Description, a.Created),
+		Tasktogo:    string(b),
+	}
+}
+
+// archivedUUID gives the UUID of the completed task, which is made from
+// its name and when it was completed if it had no ID.
+func archivedUUID(a *ArchivedTask) string {
+	if a.ID == "" {
+		return twUUID(a.Name + "@" + twTime(a.Completed))
+	}
+	return twUUID(a.ID)
+}
+
+// twRecur describes the recurrence of the generator as a Taskwarrior
+// duration, such as "weekly" or "3d", and reports whether it is exact.
+// Recurrence rules which only give a frequency and interval are exact,
+// as are single delays from the due date. Others are described by
+// their frequency or first delay.
+func (g *RecurringTaskGenerator) twRecur() (recur string, exact bool) {
+	if r := g.Rule; r != nil {
+		exact = len(r.ByDay) == 0 && len(r.ByMonthDay) == 0 &&
+			len(r.BySetPos) == 0 && r.Count == 0 && r.Until.IsZero()
+		n := strconv.Itoa(r.Interval)
+		switch r.Freq {
+		case FreqDaily:
+			return n + "d", exact
+		case FreqWeekly:
+			return n + "w", exact
+		case FreqMonthly:
+			return n + "mo", exact
+		}
+		return n + "y", exact
+	}
+	if len(g.Delay) == 0 {
+		return "", false
+	}
+	return twDuration(g.Delay[0]), len(g.Delay) == 1 && !g.AfterCompletion
+}
+
+// twDuration formats a delay as a Taskwarrior duration.
+func twDuration(d time.Duration) string {
+	switch {
+	case d%(7*24*time.Hour) == 0:
+		return strconv.FormatInt(int64(d/(7*24*time.Hour)), 10) + "w"
+	case d%(24*time.Hour) == 0:
+		return strconv.FormatInt(int64(d/(24*time.Hour)), 10) + "d"
+	case d%time.Hour == 0:
+		return strconv.FormatInt(int64(d/time.Hour), 10) + "h"
+	case d%time.Minute == 0:
+		return strconv.FormatInt(int64(d/time.Minute), 10) + "min"
+	}
+	return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+}
+
+// twTime formats a time as Taskwarrior does, or gives an empty string
+// for the zero time.
+func twTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(TaskwarriorTimeFormat)
+}
+
+// twPriority gives the Taskwarrior priority nearest to a priority.
+func twPriority(priority int) string {
+	switch {
+	case priority == 1:
+		return "H"
+	case priority == 2:
+		return "M"
+	case priority == 3 || priority == 4:
+		return "L"
+	}
+	return ""
+}
+
+// twAnnotations gives an annotation for each line of a description.
+// Taskwarrior identifies annotations by when they were made, so each
+// is a second after the last.
+func twAnnotations(description string, created time.Time) (
+	annotations []twAnnotation) {
+
+	for _, line := range strings.Split(description, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		entry := created.Add(time.Duration(len(annotations)) * time.Second)
+		annotations = append(annotations, twAnnotation{
+			Entry:       twTime(entry),
+			Description: line,
+		})
+	}
+	return
+}
+
+// twUUID gives the ID as a UUID, which it already is unless it is that
+// of a task of a recurring task, or there is none. Those are given one
+// made from a hash of the ID, so that it stays the same.
+func twUUID(id string) string {
+	if len(id) == 36 && strings.Count(id, "-") == 4 {
+		return id
+	}
+	b := sha1.Sum([]byte(id))
+	b[6] = (b[6] & 0x0f) | 0x50
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10],
+		b[10:16])
+}
+
+// storedJSON encodes the TaskContainer as it is stored, without its
+// subtasks.
+func storedJSON(c TaskContainer) string {
+	children := c.Children()
+	c.SetChildren(nil)
+	b, _ := json.Marshal(c)
+	c.SetChildren(children)
+	return string(b)
+}
+
+// ImportTaskwarrior reads tasks from the JSON written by Taskwarrior's
+// "task export", either as a list or one task on each line. Tasks keep
+// their UUIDs as their IDs, so those which already exist are updated,
+// and completed tasks complete them or are added to the archive.
+// Deleted tasks are ignored. The tasks of recurring tasks complete,
+// skip, or change them.
+func ImportTaskwarrior(ctx *Context, r io.Reader) (result Imported, err error) {
+	tasks, err := readTWTasks(r)
+	if err != nil {
+		return result, err
+	}
+
+	fl := &ctx.fileList
+	var kept, occurrences []*twTask
+	added := make(map[*twTask]TaskContainer)
+	for _, t := range tasks {
+		switch {
+		case t.Parent != "":
+			occurrences = append(occurrences, t)
+			continue
+		case t.Status == twCompleted:
+			if ctx.importTWCompleted(t) {
+				result.Completed++
+			}
+			continue
+		case t.Status == twDeleted:
+			continue
+		}
+
+		old := fl.container(t.UUID)
+		c, err := t.container(old)
+		if err != nil {
+			ctx.warn("skipped %q: %s\n", t.Description, err)
+			continue
+		}
+		kept = append(kept, t)
+		if old == nil {
+			fl.Add(c)
+			added[t] = c
+			result.Added = append(result.Added, c)
+			continue
+		}
+
+		_, oldAlias := old.(identity).identify()
+		_, alias := c.(identity).identify()
+		*alias = *oldAlias
+		if storedJSON(old) != storedJSON(c) {
+			c.SetChildren(old.Children())
+			fl.Replace(old, c)
+			result.Updated++
+		}
+	}
+
+	// Now that every task has been added, the new ones can be nested
+	// beneath their parents, and recurring tasks brought up to date
+	// with their masks.
+	for _, t := range kept {
+		if c := added[t]; c != nil {
+			parent := fl.container(t.TasktogoParent)
+			if parent != nil && parent != c {
+				fl.Remove(c)
+				fl.AddSubtask(parent, c)
+			}
+		}
+		if g, ok := fl.container(t.UUID).(*RecurringTaskGenerator); ok {
+			done, skipped := g.importTWMask(t.Mask, fl)
+			result.Completed += done
+			result.Updated += skipped
+		}
+	}
+
+	sort.SliceStable(occurrences, func(i, j int) bool {
+		return occurrences[i].occurrence() < occurrences[j].occurrence()
+	})
+	for _, t := range occurrences {
+		g, ok := fl.container(t.Parent).(*RecurringTaskGenerator)
+		n := t.occurrence()
+		if !ok || n < 1 || g.finished(n) {
+			continue
+		}
+		switch t.Status {
+		case twCompleted:
+			fl.Complete(g.SpawnTask(n), t.end(ctx.Now()))
+			result.Completed++
+		case twDeleted:
+			g.Skip(n, fl)
+			result.Updated++
+		default:
+			// Taskwarrior's own tasks only fall on those of the
+			// recurring task if it recurs as Taskwarrior's do.
+			_, exact := g.twRecur()
+			c, err := t.fields()
+			if err == nil && exact && g.overrideWith(n, c) {
+				result.Updated++
+			}
+		}
+	}
+	return result, nil
+}
+
+// readTWTasks decodes Taskwarrior tasks, given either as a JSON list
+// or as a JSON object on each line.
+func readTWTasks(r io.Reader) (tasks []*twTask, err error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '[' {
+		err = json.Unmarshal(b, &tasks)
+		return
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	for d.More() {
+		t := &twTask{}
+		if err = d.Decode(t); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	return
+}
+
+// container produces the task described by the Taskwarrior task. If
+// it was exported by tasktogo, or replaces the given one, it is that
+// task, with any of the fields which Taskwarrior has that have been
+// changed.
+func (t *twTask) container(old TaskContainer) (TaskContainer, error) {
+	c, err := t.fields()
+	if err != nil {
+		return nil, err
+	}
+
+	stored := t.Tasktogo
+	if stored == "" && old != nil {
+		stored = storedJSON(old)
+	}
+	if stored == "" {
+		return c, Validate(c)
+	}
+	base, err := decodeContainer([]byte(stored), c)
+	if err != nil {
+		return c, Validate(c)
+	}
+
+	// The fields are compared as they would be exported, so that those
+	// which Taskwarrior keeps differently are only replaced if they
+	// were changed.
+	e := newTWTask(base)
+	baseName, baseDescription, basePriority := commonFields(base)
+	name, description, priority := commonFields(c)
+	baseMeta, m := metaOf(base), metaOf(c)
+	if e.Description != t.Description {
+		*baseName = *name
+	}
+	if !sameAnnotations(e.Annotations, t.Annotations) {
+		*baseDescription = *description
+	}
+	if e.Priority != t.Priority {
+		*basePriority = *priority
+	}
+	if e.Entry != t.Entry && !m.Created.IsZero() {
+		baseMeta.Created = m.Created
+	}
+	if e.Project != t.Project {
+		baseMeta.Project = m.Project
+	}
+	if !sameStrings(e.Tags, t.Tags) {
+		baseMeta.Tags = m.Tags
+	}
+	if !sameStrings(e.Depends, t.Depends) {
+		baseMeta.Depends = m.Depends
+	}
+
+	switch b := base.(type) {
+	case *DefiniteTask:
+		if e.Due != t.Due {
+			b.DueBy = c.(*DefiniteTask).DueBy
+		}
+	case *RecurringTaskGenerator:
+		if !sameTWRecur(e.Recur, t.Recur) || e.Due != t.Due ||
+			e.Until != t.Until {
+			n := c.(*RecurringTaskGenerator)
+			*b = RecurringTaskGenerator{
+				ID:      b.ID,
+				Alias:   b.Alias,
+				Start:   n.Start,
+				End:     n.End,
+				Delay:   n.Delay,
+				Rule:    n.Rule,
+				Backlog: b.Backlog,
+				Spawn:   b.Spawn,
+			}
+		}
+	}
+	return base, Validate(base)
+}
+
+// fields produces the task described by the fields of the Taskwarrior
+// task alone. Templates become recurring tasks, which start when their
+// first task is due, and others are definite tasks if they are due and
+// eventual tasks if not.
+func (t *twTask) fields() (TaskContainer, error) {
+	var m Meta
+	for _, tag := range t.Tags {
+		m.AddTag(tag)
+	}
+	m.Project, m.Depends = t.Project, t.Depends
+
+	var (
+		due, until time.Time
+		err        error
+	)
+	for _, f := range []struct {
+		name, value string
+		t           *time.Time
+	}{
+		{"entry", t.Entry, &m.Created},
+		{"due", t.Due, &due},
+		{"until", t.Until, &until},
+	} {
+		if *f.t, err = parseTWTime(f.value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q", f.name, f.value)
+		}
+	}
+
+	priority, ok := TaskwarriorPriorities[strings.ToUpper(t.Priority)]
+	if !ok {
+		priority = DefaultPriority
+	}
+	var lines []string
+	for _, a := range t.Annotations {
+		lines = append(lines, a.Description)
+	}
+	description := strings.Join(lines, "\n")
+
+	switch {
+	case t.Status == twRecurring:
+		g := &RecurringTaskGenerator{
+			ID:    t.UUID,
+			Start: due,
+			End:   until,
+			Spawn: RecurringTask{
+				Priority:    priority,
+				Name:        t.Description,
+				Description: description,
+				Meta:        m,
+			},
+		}
+		g.Delay, g.Rule, err = parseTWRecur(t.Recur)
+		if err != nil {
+			return nil, err
+		}
+		return g, nil
+	case due.IsZero():
+		return &EventualTask{
+			ID:          t.UUID,
+			Priority:    priority,
+			Name:        t.Description,
+			Description: description,
+			Meta:        m,
+		}, nil
+	}
+	return &DefiniteTask{
+		ID:          t.UUID,
+		Priority:    priority,
+		DueBy:       due,
+		Name:        t.Description,
+		Description: description,
+		Meta:        m,
+	}, nil
+}
+
+// importTWCompleted completes the outstanding task with the UUID of
+// the completed Taskwarrior task, and returns true, or otherwise adds
+// a record of it to the archive if it has none.
+func (ctx *Context) importTWCompleted(t *twTask) bool {
+	fl := &ctx.fileList
+	if c := fl.container(t.UUID); c != nil {
+		if task, ok := c.(Task); ok {
+			fl.Complete(task, t.end(ctx.Now()))
+			return true
+		}
+	}
+
+	a := &ArchivedTask{}
+	if t.Tasktogo == "" || json.Unmarshal([]byte(t.Tasktogo), a) != nil {
+		c, err := t.fields()
+		task, ok := c.(Task)
+		if err != nil || !ok {
+			return false
+		}
+		a = NewArchivedTask(task, t.end(ctx.Now()))
+	}
+	for _, other := range fl.Archive {
+		if archivedUUID(other) == t.UUID {
+			return false
+		}
+	}
+	fl.Archive = append(fl.Archive, a)
+	return false
+}
+
+// importTWMask completes or skips the tasks of the recurring task
+// which the mask of its template records as done or deleted, and
+// counts them. Taskwarrior's mask does not replace what is known of
+// tasks which have already been completed or skipped.
+func (g *RecurringTaskGenerator) importTWMask(mask string, fl *fileList) (
+	done, skipped int) {
+
+	for i, c := range mask {
+		n := i + 1
+		if g.finished(n) || g.exhausted(n) {
+			continue
+		}
+		switch c {
+		case twMaskDone:
+			g.Done(n, fl)
+			done++
+		case twMaskDeleted:
+			g.Skip(n, fl)
+			skipped++
+		}
+	}
+	return
+}
+
+// occurrence gives the occurrence number of a task of a recurring
+// task, which Taskwarrior counts from zero, or 0 if it has none.
+func (t *twTask) occurrence() int {
+	n, err := t.IMask.Int64()
+	if err != nil {
+		f, err := t.IMask.Float64()
+		if err != nil {
+			return 0
+		}
+		n = int64(f)
+	}
+	return int(n) + 1
+}
+
+// end gives the time at which the task was completed, or the given
+// time if it has none.
+func (t *twTask) end(now time.Time) time.Time {
+	if end, err := parseTWTime(t.End); err == nil && !end.IsZero() {
+		return end
+	}
+	return now
+}
+
+// parseTWTime parses a time written by Taskwarrior, which is in UTC,
+// into local time. An empty string gives the zero time.
+func parseTWTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(TaskwarriorTimeFormat, value)
+	if err != nil {
+		t, err = time.Parse(time.RFC3339, value)
+	}
+	return t.Local(), err
+}
+
+// twNamedDurations are the named durations of Taskwarrior which are
+// recurrence rules, or delays given in days.
+var twNamedDurations = map[string]string{
+	"daily": "1d", "day": "1d", "weekly": "1w", "week": "1w",
+	"sennight": "1w", "biweekly": "2w", "fortnight": "2w",
+	"monthly": "1mo", "month": "1mo", "bimonthly": "2mo",
+	"quarterly": "3mo", "semiannual": "6mo", "yearly": "1y",
+	"annual": "1y", "year": "1y", "biannual": "2y", "biyearly": "2y",
+}
+
+// twUnit gives the length of a unit of Taskwarrior durations, or for
+// months, quarters, and years, the frequency of a recurrence rule and
+// its interval.
+func twUnit(unit string) (d time.Duration, freq string, interval int,
+	ok bool) {
+
+	switch unit {
+	case "s", "sec", "secs", "second", "seconds":
+		d = time.Second
+	case "min", "mins", "minute", "minutes":
+		d = time.Minute
+	case "h", "hr", "hrs", "hour", "hours":
+		d = time.Hour
+	case "d", "day", "days":
+		d = 24 * time.Hour
+	case "w", "wk", "wks", "week", "weeks":
+		d = 7 * 24 * time.Hour
+	case "mo", "mos", "mth", "mths", "mnths", "month", "months":
+		return 0, FreqMonthly, 1, true
+	case "q", "qtr", "qtrs", "quarter", "quarters":
+		return 0, FreqMonthly, 3, true
+	case "y", "yr", "yrs", "year", "years":
+		return 0, FreqYearly, 1, true
+	default:
+		return 0, "", 0, false
+	}
+	return d, "", 0, true
+}
+
+// parseTWRecur parses the recurrence of a Taskwarrior task, such as
+// "weekly" or "3d". Months and years become recurrence rules, as does
+// "weekdays", and other durations delays.
+func parseTWRecur(recur string) ([]time.Duration, *RRule, error) {
+	s := strings.ToLower(strings.TrimSpace(recur))
+	if s == "weekdays" {
+		r, err := ParseRRule("FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR")
+		return nil, r, err
+	}
+	if named, ok := twNamedDurations[s]; ok {
+		s = named
+	}
+
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsDigit(r)
+	})
+	if i < 0 {
+		return nil, nil, fmt.Errorf("invalid recurrence %q", recur)
+	}
+	n := 1
+	if i > 0 {
+		n, _ = strconv.Atoi(s[:i])
+	}
+	if n < 1 {
+		return nil, nil, fmt.Errorf("invalid recurrence %q", recur)
+	}
+
+	d, freq, interval, ok := twUnit(s[i:])
+	switch {
+	case !ok:
+		return nil, nil, fmt.Errorf("invalid recurrence %q", recur)
+	case freq != "":
+		return nil, &RRule{Freq: freq, Interval: n * interval}, nil
+	}
+	return []time.Duration{time.Duration(n) * d}, nil, nil
+}
+
+// sameTWRecur checks whether two Taskwarrior recurrences are the
+// same, whichever way they are written.
+func sameTWRecur(a, b string) bool {
+	aDelay, aRule, aErr := parseTWRecur(a)
+	bDelay, bRule, bErr := parseTWRecur(b)
+	if aErr != nil || bErr != nil {
+		return a == b
+	}
+	if len(aDelay) != len(bDelay) || (aRule == nil) != (bRule == nil) {
+		return false
+	}
+	for i := range aDelay {
+		if aDelay[i] != bDelay[i] {
+			return false
+		}
+	}
+	return aRule == nil || aRule.String() == bRule.String()
+}
+
+// sameAnnotations checks whether two lists of annotations have the
+// same text.
+func sameAnnotations(a, b []twAnnotation) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Description != b[i].Description {
+			return false
+		}
+	}
+	return true
+}
+
+// sameStrings checks whether two lists of strings are the same.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/SashaCrofter/reltime"
+	"github.com/aybabtme/color"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultListTemplate renders each task in the list view, as it is
+// formatted by its String method, beneath its alias.
+const DefaultListTemplate = `{{printf "%4s" .Alias}} {{indent .Depth}}` +
+	`{{color . (printf "(%d) %s- %s%s%s\n" .Priority (due .DueBy) .Name ` +
+	`(missed .Missed) .Labels)}}`
+
+var (
+	// Paints are the colors which may be named in list templates.
+	Paints = map[string]color.Paint{
+		"red":    color.RedPaint,
+		"yellow": color.YellowPaint,
+		"green":  color.GreenPaint,
+		"cyan":   color.CyanPaint,
+		"blue":   color.BluePaint,
+		"purple": color.PurplePaint,
+	}
+
+	// TemplateFuncs are the functions available to list templates, in
+	// addition to those built into package text/template.
+	TemplateFuncs = template.FuncMap{
+		// reltime formats a date relative to now, as in the list
+		// view, and due does the same followed by a space, or gives
+		// nothing for eventual tasks.
+		"reltime": func(t time.Time) string {
+			return reltime.FormatRelative(RelFmt, DueFmt, t)
+		},
+		"due": func(t time.Time) string {
+			if t.IsZero() {
+				return ""
+			}
+			return reltime.FormatRelative(RelFmt, DueFmt, t) + " "
+		},
+
+		// indent gives the indentation of subtasks at the given
+		// depth, and missed labels tasks which stand for missed ones.
+		"indent": func(depth int) string {
+			return strings.Repeat(SubtaskIndent, depth)
+		},
+		"missed": missedLabel,
+
+		// color colors a string as the task is colored in the list
+		// view, dateColor and priorityColor color it according to a
+		// due date or priority, and paint colors it by name, such as
+		// "red". Nothing is colored if colors are disabled.
+		"color": func(t *TemplateTask, s string) string {
+			return BrushConditionally(Ctx, t.brush())(s)
+		},
+		"dateColor": func(due time.Time, s string) string {
+			return BrushConditionally(Ctx,
+				ColorForDate(due, ColorThreshold))(s)
+		},
+		"priorityColor": func(priority int, s string) string {
+			return BrushConditionally(Ctx,
+				ColorForPriority(priority, EventualThreshold))(s)
+		},
+		"paint": func(name, s string) (string, error) {
+			paint, ok := Paints[strings.ToLower(name)]
+			if !ok {
+				return "", fmt.Errorf("unknown color %q", name)
+			}
+			return BrushConditionally(Ctx,
+				color.NewBrush(color.Paint(""), paint))(s), nil
+		},
+	}
+)
+
+// TemplateTask is the data given to list templates for each task. It
+// has every field of the TaskInfo, along with those calculated when
+// the list is made.
+type TemplateTask struct {
+	TaskInfo
+
+	// Nice is the nice value of the task, and Urgency is the sum of
+	// the terms of its urgency, which are given by Terms.
+	Nice    int
+	Urgency float64
+	Terms   []UrgencyTerm
+
+	// Depth is how deeply the task is nested as a subtask, and
+	// Subtasks and SubtasksDone are the number of its subtasks and how
+	// many have been completed.
+	Depth, Subtasks, SubtasksDone int
+
+	// Blockers and Dependents are the aliases of the tasks which the
+	// task depends on, and which depend on it.
+	Blockers, Dependents []string
+}
+
+// NewTemplateTask describes the given Task for list templates, with
+// its urgency at the given time.
+func NewTemplateTask(t Task, now time.Time) *TemplateTask {
+	info := t.Info()
+	data := &TemplateTask{
+		TaskInfo:     info,
+		Nice:         t.Nice(),
+		Terms:        urgency().Explain(t, now),
+		Depth:        info.depth,
+		Subtasks:     info.subtasks,
+		SubtasksDone: info.subtasksDone,
+	}
+	for _, term := range data.Terms {
+		data.Urgency += term.Value()
+	}
+	for _, b := range info.blockers {
+		data.Blockers = append(data.Blockers, b.Info().Alias)
+	}
+	for _, d := range info.dependents {
+		data.Dependents = append(data.Dependents, d.Info().Alias)
+	}
+	return data
+}
+
+// brush returns the color.Brush with which the task is colored in the
+// list view, according to its due date, or its priority if it has
+// none.
+func (t *TemplateTask) brush() color.Brush {
+	if t.DueBy.IsZero() {
+		return ColorForPriority(t.Priority, EventualThreshold)
+	}
+	return ColorForDate(t.DueBy, ColorThreshold)
+}
+
+// ParseListTemplate parses a template for the list view, with the
+// TemplateFuncs available to it. Each task is rendered on its own
+// line, so a newline is added to the end of the template if it does
+// not have one.
+func ParseListTemplate(text string) (*template.Template, error) {
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return parseListTemplate(text)
+}
+
+// parseListTemplate parses a template for the list view as it is.
+func parseListTemplate(text string) (*template.Template, error) {
+	return template.New("list").Funcs(TemplateFuncs).Parse(text)
+}
+
+// DefaultTemplate is the parsed DefaultListTemplate. Its newline is
+// colored along with the rest of the task, so it is parsed as it is.
+var DefaultTemplate = template.Must(parseListTemplate(DefaultListTemplate))
+
+// listTemplate returns the template used for the list view, which is
+// the DefaultTemplate unless another is given.
+func (ctx *Context) listTemplate() *template.Template {
+	if ctx.ListTemplate != nil {
+		return ctx.ListTemplate
+	}
+	return DefaultTemplate
+}
+
+// renderTask renders the Task with the list template.
+func (ctx *Context) renderTask(t Task) (string, error) {
+	var b bytes.Buffer
+	err := ctx.listTemplate().Execute(&b, NewTemplateTask(t, ctx.Now()))
+	return b.String(), err
+}
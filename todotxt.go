@@ -0,0 +1,919 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// TodoTxtExt is the extension of list files which are kept in the
+	// todo.txt format, rather than as JSON.
+	TodoTxtExt = ".txt"
+
+	// TodoTxtDateFormat is the format of dates in todo.txt lines.
+	// Times in extensions are given as dates if they are at the end of
+	// the working day, and in TodoTxtTimeFormat otherwise.
+	TodoTxtDateFormat = "2006-01-02"
+	TodoTxtTimeFormat = "2006-01-02T15:04"
+
+	// maxTodoTxtLine is the length of the longest line which can be
+	// read, which is mostly taken up by descriptions.
+	maxTodoTxtLine = 1 << 20
+)
+
+// todoTxtRec matches recurrences as other programs write them, as a
+// number of days, weeks, months, years, or business days.
+var todoTxtRec = regexp.MustCompile(`^([0-9]+)([dwmyb])$`)
+
+// todoTxtWeekdays is the rule of tasks which recur every business day.
+const todoTxtWeekdays = "FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR"
+
+// The keys of the key:value extensions which are read from and written
+// to todo.txt lines. The first few are understood by other programs,
+// and the rest hold what only tasktogo keeps. Words with other keys are
+// left in the name of the task, so that they are written back as they
+// were.
+const (
+	todoDue        = "due"
+	todoPri        = "pri"
+	todoRec        = "rec"
+	todoProject    = "project"
+	todoDepends    = "depends"
+	todoParent     = "parent"
+	todoDesc       = "desc"
+	todoUID        = "uid"
+	todoID         = "id"
+	todoAlias      = "alias"
+	todoStart      = "start"
+	todoEnd        = "end"
+	todoDone       = "done"
+	todoExcept     = "except"
+	todoLastDone   = "lastdone"
+	todoBacklog    = "backlog"
+	todoOverride   = "override"
+	todoType       = "type"
+	todoOccurrence = "occurrence"
+	todoName       = "name"
+)
+
+// todoTxtKeys are the keys of the extensions which are understood.
+var todoTxtKeys = map[string]bool{
+	todoDue: true, todoPri: true, todoRec: true, todoProject: true,
+	todoDepends: true, todoParent: true, todoDesc: true, todoUID: true,
+	todoID: true, todoAlias: true, todoStart: true, todoEnd: true,
+	todoDone: true, todoExcept: true, todoLastDone: true,
+	todoBacklog: true, todoOverride: true, todoType: true,
+	todoOccurrence: true, todoName: true,
+}
+
+// IsTodoTxt reports whether the list file at path is kept in the
+// todo.txt format, which is decided by its extension both when it is
+// read and when it is written. Backups are in the format of the list
+// they were made from.
+func IsTodoTxt(path string) bool {
+	if i := strings.LastIndex(path, BackupSuffix); i > 0 {
+		if _, err := strconv.Atoi(path[i+len(BackupSuffix):]); err == nil {
+			path = path[:i]
+		}
+	}
+	return strings.EqualFold(filepath.Ext(path), TodoTxtExt)
+}
+
+// ExportTodoTxt writes the tasks of the Context in the todo.txt
+// format, as they would be kept in a todo.txt list file.
+func ExportTodoTxt(ctx *Context, w io.Writer) error {
+	return ctx.fileList.WriteTodoTxt(w)
+}
+
+// WriteTodoTxt writes the fileList in the todo.txt format. Each task,
+// subtask, and recurring task has a line, in the order they are
+// stored, followed by any lines which could not be read, and a
+// completed line for each task in the Archive.
+func (fl fileList) WriteTodoTxt(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fl.walk(func(c, parent TaskContainer) {
+		fmt.Fprintln(bw, todoTxtTask(c, parent))
+	})
+	for _, u := range fl.unread {
+		fmt.Fprintln(bw, u.text)
+	}
+	for _, a := range fl.Archive {
+		fmt.Fprintln(bw, todoTxtArchived(a))
+	}
+	return bw.Flush()
+}
+
+// asTodoTxt replaces the fileList with what is read back after writing
+// it in the todo.txt format, which keeps times to the minute, and the
+// times at which tasks were created and completed only to the day.
+func (fl *fileList) asTodoTxt() error {
+	var b bytes.Buffer
+	if err := fl.WriteTodoTxt(&b); err != nil {
+		return err
+	}
+	read, err := ReadTodoTxt(&b)
+	if err != nil {
+		return err
+	}
+	*fl = read
+	return nil
+}
+
+// todoTxtTask formats a TaskContainer, which is a subtask of the given
+// parent if it is not nil, as a todo.txt line. Recurring tasks have a
+// single line, which is due when their first outstanding task is.
+func todoTxtTask(c, parent TaskContainer) string {
+	name, description, priority := commonFields(c)
+	m := metaOf(c)
+
+	var head, ext []string
+	if letter, ok := todoTxtPriority(*priority); ok {
+		head = append(head, "("+letter+")")
+	} else {
+		ext = append(ext, todoTxtExt(todoPri, strconv.Itoa(*priority)))
+	}
+	if !m.Created.IsZero() {
+		head = append(head, m.Created.Format(TodoTxtDateFormat))
+	}
+
+	switch c := c.(type) {
+	case *DefiniteTask:
+		ext = append(ext, todoTxtExt(todoDue, todoTxtTime(c.DueBy)))
+	case *RecurringTaskGenerator:
+		ext = append(ext, c.todoTxtExtensions()...)
+	}
+
+	ext = append(ext, todoTxtMeta(*description, m)...)
+	ext = append(ext, todoTxtExt(todoParent, containerID(parent)))
+	id, alias := c.(identity).identify()
+	ext = append(ext, todoTxtExt(todoID, *id))
+	if *alias != 0 {
+		ext = append(ext, todoTxtExt(todoAlias, strconv.Itoa(*alias)))
+	}
+	return todoTxtJoin(head, *name, m, ext)
+}
+
+// todoTxtArchived formats an ArchivedTask as a completed todo.txt line.
+// As is conventional, its priority is given by an extension.
+func todoTxtArchived(a *ArchivedTask) string {
+	head := []string{"x"}
+	if !a.Completed.IsZero() {
+		head = append(head, a.Completed.Format(TodoTxtDateFormat))
+		if !a.Created.IsZero() {
+			head = append(head, a.Created.Format(TodoTxtDateFormat))
+		}
+	}
+
+	var ext []string
+	if letter, ok := todoTxtPriority(a.Priority); ok {
+		ext = append(ext, todoTxtExt(todoPri, letter))
+	} else if a.Priority != 0 {
+		ext = append(ext, todoTxtExt(todoPri, strconv.Itoa(a.Priority)))
+	}
+	if !a.DueBy.IsZero() {
+		ext = append(ext, todoTxtExt(todoDue, todoTxtTime(a.DueBy)))
+	}
+	if a.Type == TypeRecurring {
+		ext = append(ext, todoTxtExt(todoType, a.Type),
+			todoTxtExt(todoOccurrence, strconv.Itoa(a.Occurrence)))
+	}
+	ext = append(ext, todoTxtMeta(a.Description, &a.Meta)...)
+	ext = append(ext, todoTxtExt(todoParent, a.Parent),
+		todoTxtExt(todoID, a.ID))
+	return todoTxtJoin(head, a.Name, &a.Meta, ext)
+}
+
+// todoTxtExtensions gives the extensions which describe the schedule
+// and progress of the recurring task. The recurrence is written as
+// other programs write it, with a "+" before delays from the due date,
+// and none before delays from completion.
+func (g *RecurringTaskGenerator) todoTxtExtensions() (ext []string) {
+	if first := g.firstOutstanding(); !g.exhausted(first) {
+		ext = append(ext, todoTxtExt(todoDue, todoTxtTime(g.DueByID(first))))
+	}
+
+	var rec string
+	if g.Rule != nil {
+		rec = todoTxtRule(g.Rule)
+	} else {
+		delays := make([]string, len(g.Delay))
+		for i, d := range g.Delay {
+			delays[i] = formatDelay(d)
+		}
+		rec = strings.Join(delays, ",")
+		if !g.AfterCompletion {
+			rec = "+" + rec
+		}
+	}
+	ext = append(ext, todoTxtExt(todoRec, rec),
+		todoTxtExt(todoStart, todoTxtTime(g.Start)))
+	if !g.End.IsZero() {
+		ext = append(ext, todoTxtExt(todoEnd, todoTxtTime(g.End)))
+	}
+	if g.LastCompleted > 0 {
+		ext = append(ext,
+			todoTxtExt(todoDone, strconv.Itoa(g.LastCompleted)))
+	}
+	if len(g.Except) > 0 {
+		ext = append(ext, todoTxtExt(todoExcept, joinInts(g.Except)))
+	}
+	if !g.LastDone.IsZero() {
+		ext = append(ext, todoTxtExt(todoLastDone, todoTxtTime(g.LastDone)))
+	}
+	if g.Backlog != nil {
+		ext = append(ext, todoTxtExt(todoBacklog, g.Backlog.String()))
+	}
+
+	// Overrides are written as "override:N=..." with the Override
+	// encoded as JSON, and escaped so that it has no spaces.
+	var occurrences []int
+	for n := range g.Overrides {
+		occurrences = append(occurrences, n)
+	}
+	sort.Ints(occurrences)
+	for _, n := range occurrences {
+		b, err := json.Marshal(g.Overrides[n])
+		if err != nil {
+			continue
+		}
+		ext = append(ext, todoTxtExt(todoOverride,
+			strconv.Itoa(n)+"="+url.PathEscape(string(b))))
+	}
+	return
+}
+
+// todoTxtRule formats a recurrence rule as other programs write it, if
+// it recurs every so many months or years, or every business day.
+func todoTxtRule(r *RRule) string {
+	switch s := r.String(); s {
+	case todoTxtWeekdays:
+		return "+1b"
+	case (&RRule{Freq: FreqMonthly, Interval: r.Interval}).String():
+		return "+" + strconv.Itoa(r.Interval) + "m"
+	case (&RRule{Freq: FreqYearly, Interval: r.Interval}).String():
+		return "+" + strconv.Itoa(r.Interval) + "y"
+	default:
+		return s
+	}
+}
+
+// todoTxtMeta gives the extensions which describe the Meta and
+// description of a task, other than its tags.
+func todoTxtMeta(description string, m *Meta) []string {
+	return []string{
+		todoTxtExt(todoProject, m.Project),
+		todoTxtExt(todoDepends, strings.Join(m.Depends, ",")),
+		todoTxtExt(todoDesc, url.PathEscape(description)),
+		todoTxtExt(todoUID, url.PathEscape(m.UID)),
+	}
+}
+
+// todoTxtJoin forms a todo.txt line from the words which come before
+// the name, the name itself, the tags of the Meta as projects or
+// contexts, and the extensions, leaving out those which are empty.
+func todoTxtJoin(head []string, name string, m *Meta, ext []string) string {
+	plain, escaped := todoTxtName(name)
+	words := head
+	if plain != "" {
+		words = append(words, plain)
+	}
+	ext = append([]string{escaped}, ext...)
+	for _, tag := range m.Tags {
+		if m.IsContext(tag) {
+			words = append(words, "@"+tag)
+		} else {
+			words = append(words, "+"+tag)
+		}
+	}
+	for _, e := range ext {
+		if e != "" {
+			words = append(words, e)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// todoTxtName gives the words of a name which are read back as part
+// of it. Words which would be read as something else, such as tags,
+// extensions, or the priority or dates at the beginning of the line,
+// are left out, and the whole name is then given by a "name"
+// extension, escaped so that it has no spaces.
+func todoTxtName(name string) (plain, ext string) {
+	var words []string
+	for _, word := range strings.Fields(name) {
+		key, _ := splitTodoTxtExt(word)
+		if key == "" && !isTodoTxtTag(word, '+') &&
+			!isTodoTxtTag(word, '@') {
+
+			words = append(words, word)
+		}
+	}
+	for len(words) > 0 && isTodoTxtHead(words[0]) {
+		words = words[1:]
+	}
+
+	plain = strings.Join(words, " ")
+	if plain != name {
+		ext = todoTxtExt(todoName, url.PathEscape(name))
+	}
+	return plain, ext
+}
+
+// todoTxtExt formats a key:value extension, or gives an empty string
+// if the value is empty.
+func todoTxtExt(key, value string) string {
+	if value == "" {
+		return ""
+	}
+	return key + ":" + value
+}
+
+// todoTxtTime formats a time for an extension.
+func todoTxtTime(t time.Time) string {
+	t = t.Local()
+	if t.Hour() == EndOfDayHour && t.Minute() == 0 && t.Second() == 0 {
+		return t.Format(TodoTxtDateFormat)
+	}
+	return t.Format(TodoTxtTimeFormat)
+}
+
+// todoTxtPriority gives the letter of a priority from 1 to 26, which
+// are written as "(A)" to "(Z)".
+func todoTxtPriority(priority int) (string, bool) {
+	if priority < 1 || priority > 26 {
+		return "", false
+	}
+	return string(rune('A' + priority - 1)), true
+}
+
+// formatDelay formats a delay as ParseDelays understands it, in weeks
+// or days where possible.
+func formatDelay(d time.Duration) string {
+	const day = 24 * time.Hour
+	switch {
+	case d != 0 && d%(7*day) == 0:
+		return strconv.FormatInt(int64(d/(7*day)), 10) + "w"
+	case d != 0 && d%day == 0:
+		return strconv.FormatInt(int64(d/day), 10) + "d"
+	}
+	return d.String()
+}
+
+// todoTxtLine is a line read from a todo.txt file, separated into its
+// parts. The extensions which only some tasks have are left in ext.
+type todoTxtLine struct {
+	done      bool
+	completed time.Time
+
+	// priority is zero if the line gives none.
+	priority          int
+	name, description string
+	due               time.Time
+	meta              Meta
+
+	id, parent string
+	alias      int
+
+	ext       map[string]string
+	overrides []string
+}
+
+// unreadLine is a line of a todo.txt list which could not be read, and
+// why.
+type unreadLine struct {
+	n    int
+	text string
+	err  error
+}
+
+// ReadTodoTxt reads a fileList from the todo.txt format. Completed
+// lines are read into the Archive, and those with a "rec" extension
+// become recurring tasks. Tasks with a "parent" extension are nested
+// beneath the task with that ID, if it is in the list. Lines which
+// cannot be read, such as those without a name, are kept in the
+// fileList as they are, rather than failing the whole list.
+func ReadTodoTxt(r io.Reader) (fl fileList, err error) {
+	var (
+		containers []TaskContainer
+		parents    = make(map[TaskContainer]string)
+		byID       = make(map[string]TaskContainer)
+	)
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxTodoTxtLine)
+	for n := 1; s.Scan(); n++ {
+		l, err := parseTodoTxtLine(s.Text())
+		if err == nil && l == nil {
+			continue
+		}
+
+		var c TaskContainer
+		if err == nil && l.done {
+			var a *ArchivedTask
+			if a, err = l.archived(); err == nil {
+				fl.Archive = append(fl.Archive, a)
+				continue
+			}
+		} else if err == nil {
+			if c, err = l.container(); err == nil {
+				err = Validate(c)
+			}
+		}
+		if err != nil {
+			glog.Warningf("Could not read todo.txt line %d: %s\n", n, err)
+			fl.unread = append(fl.unread, unreadLine{n, s.Text(), err})
+			continue
+		}
+
+		containers = append(containers, c)
+		parents[c] = l.parent
+		if l.id != "" {
+			byID[l.id] = c
+		}
+	}
+	if err = s.Err(); err != nil {
+		return
+	}
+
+	// Now that every task has been read, they can be nested beneath
+	// their parents, unless that would make a cycle.
+	for _, c := range containers {
+		parent := byID[parents[c]]
+		for p := parent; p != nil; p = byID[parents[p]] {
+			if p == c {
+				parent = nil
+				break
+			}
+		}
+
+		if parent == nil {
+			fl.add(c)
+			continue
+		}
+		if parent.Children() == nil {
+			parent.SetChildren(&fileList{})
+		}
+		parent.Children().add(c)
+	}
+	return
+}
+
+// parseTodoTxtLine separates a todo.txt line into its parts, or
+// returns nil if it is blank. The completion date follows the "x" of
+// completed lines, and the creation date follows that or the priority.
+func parseTodoTxtLine(text string) (l *todoTxtLine, err error) {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return nil, nil
+	}
+
+	l = &todoTxtLine{ext: make(map[string]string)}
+	if words[0] == "x" {
+		l.done = true
+		words = words[1:]
+		if len(words) > 0 {
+			if date, ok := parseTodoTxtDate(words[0]); ok {
+				l.completed = date
+				words = words[1:]
+			}
+		}
+	} else if priority, ok := parseTodoTxtPriority(words[0]); ok {
+		l.priority = priority
+		words = words[1:]
+	}
+	if len(words) > 0 && (!l.done || !l.completed.IsZero()) {
+		if date, ok := parseTodoTxtDate(words[0]); ok {
+			l.meta.Created = date
+			words = words[1:]
+		}
+	}
+
+	var name []string
+	for _, word := range words {
+		key, value := splitTodoTxtExt(word)
+		switch {
+		case isTodoTxtTag(word, '+'):
+			l.meta.AddTag(word[1:])
+		case isTodoTxtTag(word, '@'):
+			l.meta.AddTag(word[1:])
+			if !l.meta.IsContext(word[1:]) {
+				l.meta.Contexts = append(l.meta.Contexts, word[1:])
+			}
+		case key == todoOverride:
+			l.overrides = append(l.overrides, value)
+		case key != "":
+			l.ext[key] = value
+		default:
+			name = append(name, word)
+		}
+	}
+	l.name = strings.Join(name, " ")
+	return l, l.parseCommon()
+}
+
+// parseCommon interprets the extensions which any task may have.
+func (l *todoTxtLine) parseCommon() (err error) {
+	if pri, ok := l.ext[todoPri]; ok {
+		if l.priority, ok = parseTodoTxtPriority("(" + pri + ")"); !ok {
+			if l.priority, err = strconv.Atoi(pri); err != nil {
+				return fmt.Errorf("invalid priority %q", pri)
+			}
+		}
+	}
+	if due, ok := l.ext[todoDue]; ok {
+		if l.due, err = parseTodoTxtTime(due); err != nil {
+			return fmt.Errorf("invalid due date %q", due)
+		}
+	}
+	if alias, ok := l.ext[todoAlias]; ok {
+		if l.alias, err = strconv.Atoi(alias); err != nil {
+			return fmt.Errorf("invalid alias %q", alias)
+		}
+	}
+	if name, ok := l.ext[todoName]; ok {
+		if l.name, err = url.PathUnescape(name); err != nil {
+			return fmt.Errorf("invalid name: %s", err)
+		}
+	}
+	if l.description, err = url.PathUnescape(l.ext[todoDesc]); err != nil {
+		return fmt.Errorf("invalid description: %s", err)
+	}
+	if l.meta.UID, err = url.PathUnescape(l.ext[todoUID]); err != nil {
+		return fmt.Errorf("invalid UID: %s", err)
+	}
+
+	l.id, l.parent = l.ext[todoID], l.ext[todoParent]
+	l.meta.Project = l.ext[todoProject]
+	if depends := l.ext[todoDepends]; depends != "" {
+		l.meta.Depends = strings.FieldsFunc(depends, isTagSeparator)
+	}
+	return nil
+}
+
+// container produces the task described by an outstanding line, which
+// is recurring if it has a "rec" extension, and otherwise definite if
+// it is due and eventual if not. Tasks without a priority are given
+// the DefaultPriority.
+func (l *todoTxtLine) container() (TaskContainer, error) {
+	priority := l.priority
+	if priority == 0 {
+		priority = DefaultPriority
+	}
+
+	if _, ok := l.ext[todoRec]; ok {
+		return l.generator(priority)
+	} else if l.due.IsZero() {
+		return &EventualTask{
+			ID:          l.id,
+			Alias:       l.alias,
+			Priority:    priority,
+			Name:        l.name,
+			Description: l.description,
+			Meta:        l.meta,
+		}, nil
+	}
+	return &DefiniteTask{
+		ID:          l.id,
+		Alias:       l.alias,
+		Priority:    priority,
+		DueBy:       l.due,
+		Name:        l.name,
+		Description: l.description,
+		Meta:        l.meta,
+	}, nil
+}
+
+// generator produces the recurring task described by a line. Without
+// a "start" extension, as in lines written by other programs, it
+// starts when it is due.
+func (l *todoTxtLine) generator(priority int) (g *RecurringTaskGenerator,
+	err error) {
+
+	g = &RecurringTaskGenerator{
+		ID:    l.id,
+		Alias: l.alias,
+		Spawn: RecurringTask{
+			Priority:    priority,
+			Name:        l.name,
+			Description: l.description,
+			Meta:        l.meta,
+		},
+	}
+
+	rec := l.ext[todoRec]
+	if IsRule(rec) {
+		g.Rule, err = ParseRRule(rec)
+	} else {
+		g.AfterCompletion = !strings.HasPrefix(rec, "+")
+		g.Delay, g.Rule, err = parseTodoTxtRec(strings.TrimPrefix(rec, "+"),
+			g.AfterCompletion)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid recurrence %q: %s", rec, err)
+	}
+
+	g.Start = l.due
+	for key, t := range map[string]*time.Time{
+		todoStart: &g.Start, todoEnd: &g.End, todoLastDone: &g.LastDone,
+	} {
+		if value, ok := l.ext[key]; ok {
+			if *t, err = parseTodoTxtTime(value); err != nil {
+				return nil, fmt.Errorf("invalid %s date %q", key, value)
+			}
+		}
+	}
+	if done, ok := l.ext[todoDone]; ok {
+		if g.LastCompleted, err = strconv.Atoi(done); err != nil {
+			return nil, fmt.Errorf("invalid number of tasks done %q", done)
+		}
+	}
+	if except, ok := l.ext[todoExcept]; ok {
+		for _, s := range strings.Split(except, ",") {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid exceptions %q", except)
+			}
+			g.Except = append(g.Except, n)
+		}
+	}
+	if backlog, ok := l.ext[todoBacklog]; ok {
+		if g.Backlog, err = ParseBacklogPolicy(backlog); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, value := range l.overrides {
+		i := strings.Index(value, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid override %q", value)
+		}
+		n, err := strconv.Atoi(value[:i])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid override %q", value)
+		}
+		o := &Override{}
+		encoded, err := url.PathUnescape(value[i+1:])
+		if err == nil {
+			err = json.Unmarshal([]byte(encoded), o)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid override %q", value)
+		}
+		*g.override(n) = *o
+	}
+	return g, nil
+}
+
+// parseTodoTxtRec parses a recurrence without its "+", which is a
+// number followed by "d", "w", "m", "y", or "b" for business days, as
+// other programs write it, or the delays understood by ParseDelays.
+// Months, years, and business days are not a fixed number of days, so
+// they become recurrence rules, but rules cannot recur after
+// completion, so then they are given the nearest number of days.
+func parseTodoTxtRec(rec string, afterCompletion bool) ([]time.Duration,
+	*RRule, error) {
+
+	m := todoTxtRec.FindStringSubmatch(rec)
+	if m == nil {
+		delays, err := ParseDelays(rec)
+		return delays, nil, err
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil || n < 1 {
+		return nil, nil, fmt.Errorf("invalid delay %q", rec)
+	}
+
+	const day = 24 * time.Hour
+	days := n
+	switch m[2] {
+	case "d":
+	case "w":
+		days = 7 * n
+	case "m":
+		if !afterCompletion {
+			return nil, &RRule{Freq: FreqMonthly, Interval: n}, nil
+		}
+		days = 30 * n
+	case "y":
+		if !afterCompletion {
+			return nil, &RRule{Freq: FreqYearly, Interval: n}, nil
+		}
+		days = 365 * n
+	case "b":
+		if !afterCompletion && n == 1 {
+			r, err := ParseRRule(todoTxtWeekdays)
+			return nil, r, err
+		}
+		days = (7*n + 2) / 5
+	}
+	return []time.Duration{time.Duration(days) * day}, nil, nil
+}
+
+// archived produces the record of the task described by a completed
+// line.
+func (l *todoTxtLine) archived() (a *ArchivedTask, err error) {
+	a = &ArchivedTask{
+		Completed:   l.completed,
+		Type:        l.ext[todoType],
+		ID:          l.id,
+		Parent:      l.parent,
+		Priority:    l.priority,
+		DueBy:       l.due,
+		Name:        l.name,
+		Description: l.description,
+		Meta:        l.meta,
+	}
+	if a.Type == "" && a.DueBy.IsZero() {
+		a.Type = TypeEventual
+	} else if a.Type == "" {
+		a.Type = TypeDefinite
+	}
+	if occurrence, ok := l.ext[todoOccurrence]; ok {
+		if a.Occurrence, err = strconv.Atoi(occurrence); err != nil {
+			return nil, fmt.Errorf("invalid occurrence %q", occurrence)
+		}
+	}
+	return a, nil
+}
+
+// splitTodoTxtExt separates a key:value extension into its key and
+// value, if the word is one whose key is known.
+func splitTodoTxtExt(word string) (key, value string) {
+	i := strings.Index(word, ":")
+	if i < 1 || i == len(word)-1 || !todoTxtKeys[word[:i]] {
+		return "", ""
+	}
+	return word[:i], word[i+1:]
+}
+
+// isTodoTxtTag checks whether the word is a project or context, as
+// given by the sign. As with tags on the command line, they must begin
+// with a letter.
+func isTodoTxtTag(word string, sign byte) bool {
+	return len(word) > 1 && word[0] == sign &&
+		unicode.IsLetter([]rune(word[1:])[0])
+}
+
+// isTodoTxtHead checks whether the word would be read as one of those
+// which begin a line, rather than as part of the name, if it began
+// the line.
+func isTodoTxtHead(word string) bool {
+	_, priority := parseTodoTxtPriority(word)
+	_, date := parseTodoTxtDate(word)
+	return word == "x" || priority || date
+}
+
+// parseTodoTxtPriority parses a priority from "(A)" to "(Z)".
+func parseTodoTxtPriority(word string) (int, bool) {
+	if len(word) != 3 || word[0] != '(' || word[2] != ')' ||
+		word[1] < 'A' || word[1] > 'Z' {
+		return 0, false
+	}
+	return int(word[1]-'A') + 1, true
+}
+
+// parseTodoTxtDate parses the date of creation or completion of a
+// line, which is taken to be at midnight.
+func parseTodoTxtDate(word string) (time.Time, bool) {
+	t, err := time.ParseInLocation(TodoTxtDateFormat, word, time.Local)
+	return t, err == nil
+}
+
+// parseTodoTxtTime parses a time in an extension, as written by
+// todoTxtTime. Dates are taken to be at the end of the working day.
+func parseTodoTxtTime(value string) (time.Time, error) {
+	if d, ok := parseTodoTxtDate(value); ok {
+		return time.Date(d.Year(), d.Month(), d.Day(), EndOfDayHour, 0, 0,
+			0, time.Local), nil
+	}
+	return time.ParseInLocation(TodoTxtTimeFormat, value, time.Local)
+}
+
+// ImportTodoTxt reads tasks in the todo.txt format into the Context.
+// Tasks with the ID of one which already exists replace it if they
+// differ, keeping its alias and subtasks, and others are added with
+// their IDs. Lines without an ID, such as those written by other
+// programs, replace the only task with the same name, if there is
+// one. Completed lines complete the outstanding task they describe,
+// as found by outstanding, and are otherwise ignored.
+func ImportTodoTxt(ctx *Context, r io.Reader) (result Imported, err error) {
+	in, err := ReadTodoTxt(r)
+	if err != nil {
+		return result, err
+	}
+	for _, u := range in.unread {
+		ctx.warn("skipped line %d: %s\n", u.n, u.err)
+	}
+
+	// Every task is taken from its place in the imported list before
+	// any are added, so that each can be added on its own.
+	type imported struct{ c, parent TaskContainer }
+	var tasks []imported
+	in.walk(func(c, parent TaskContainer) {
+		tasks = append(tasks, imported{c, parent})
+	})
+	for _, t := range tasks {
+		t.c.SetChildren(nil)
+	}
+
+	fl := &ctx.fileList
+	for _, t := range tasks {
+		old := fl.container(containerID(t.c))
+		if id, _ := t.c.(identity).identify(); *id == "" {
+			old = fl.named(t.c)
+		}
+		if old == nil {
+			fl.AddSubtask(fl.container(containerID(t.parent)), t.c)
+			result.Added = append(result.Added, t.c)
+			continue
+		}
+
+		// Tasks are compared as they are written, so that those which
+		// only differ in what the todo.txt format leaves out are kept.
+		oldID, oldAlias := old.(identity).identify()
+		id, alias := t.c.(identity).identify()
+		*id, *alias = *oldID, *oldAlias
+		if m := metaOf(t.c); m.Created.IsZero() {
+			m.Created = metaOf(old).Created
+		}
+		parent := fl.parentOf(old)
+		if todoTxtTask(old, parent) == todoTxtTask(t.c, parent) {
+			continue
+		}
+		t.c.SetChildren(old.Children())
+		fl.Replace(old, t.c)
+		result.Updated++
+	}
+
+	for _, a := range in.Archive {
+		task := fl.outstanding(a)
+		if task == nil {
+			continue
+		}
+		completed := a.Completed
+		if completed.IsZero() {
+			completed = ctx.Now()
+		}
+		fl.Complete(task, completed)
+		result.Completed++
+	}
+	return result, nil
+}
+
+// outstanding returns the outstanding Task which the record of a
+// completed task describes, or nil if there is none. That is the task
+// with its ID, or for records without one, such as those written by
+// other programs, the only task with its name which had been created
+// by the day it was completed.
+func (fl *fileList) outstanding(a *ArchivedTask) Task {
+	if a.ID != "" {
+		task, err := fl.List().Find(a.ID)
+		if err != nil || task.Info().ID != a.ID {
+			return nil
+		}
+		return task
+	}
+
+	var found Task
+	for _, t := range fl.List() {
+		info := t.Info()
+		if info.Name != a.Name || (!a.Completed.IsZero() &&
+			info.Created.After(a.Completed.AddDate(0, 0, 1))) {
+			continue
+		}
+		if found != nil {
+			return nil
+		}
+		found = t
+	}
+	return found
+}
+
+// named returns the only TaskContainer in the fileList with the same
+// name as the given one, or nil if there is not exactly one.
+func (fl *fileList) named(c TaskContainer) (named TaskContainer) {
+	name, _, _ := commonFields(c)
+	count := 0
+	fl.walk(func(other, _ TaskContainer) {
+		if otherName, _, _ := commonFields(other); *otherName == *name {
+			named = other
+			count++
+		}
+	})
+	if count != 1 {
+		return nil
+	}
+	return named
+}
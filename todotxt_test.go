@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTodoTxtRoundTrip checks that tasks are read back from the
+// todo.txt format as they were written, even if their names contain
+// words which look like tags, extensions, or the beginning of a line.
+func TestTodoTxtRoundTrip(t *testing.T) {
+	names := []string{
+		"pay rent",
+		"pay rent due:friday",
+		"email +alice about id:7",
+		"call re: project:x",
+		"x marks the spot",
+		"(A) is not a priority",
+		"2024-05-01 was a Wednesday",
+		"meet @home name:bob",
+		"+someday",
+		"two  spaces",
+	}
+
+	var fl fileList
+	for i, name := range names {
+		fl.add(&EventualTask{
+			ID:       string(rune('a' + i)),
+			Priority: 2,
+			Name:     name,
+			Meta:     Meta{Tags: []string{"work"}},
+		})
+	}
+
+	var b bytes.Buffer
+	if err := fl.WriteTodoTxt(&b); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadTodoTxt(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatalf("%s\n%s", err, b.String())
+	}
+
+	if len(read.Eventual) != len(names) {
+		t.Fatalf("read %d tasks, want %d\n%s", len(read.Eventual),
+			len(names), b.String())
+	}
+	for i, task := range read.Eventual {
+		if task.Name != names[i] {
+			t.Errorf("name read as %q, want %q", task.Name, names[i])
+		}
+		if len(task.Tags) != 1 || task.Tags[0] != "work" {
+			t.Errorf("%q read with tags %q, want [work]", names[i],
+				task.Tags)
+		}
+		if task.Project != "" {
+			t.Errorf("%q read with project %q", names[i], task.Project)
+		}
+	}
+}
+
+// TestTodoTxtUndoKeepsUnread checks that lines which could not be read
+// are kept when changes to the list are undone.
+func TestTodoTxtUndoKeepsUnread(t *testing.T) {
+	const broken = "(B) Broken due:notadate"
+	fl, err := ReadTodoTxt(strings.NewReader("(A) Kept id:a\n" + broken +
+		"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := fl.sections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fl.add(&EventualTask{ID: "b", Priority: 2, Name: "New"})
+	after, err := fl.sections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &JournalEntry{Changes: before.Diff(after)}
+	if err = applyEntry(&fl, entry, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := fl.WriteTodoTxt(&b); err != nil {
+		t.Fatal(err)
+	}
+	if len(fl.Eventual) != 1 || fl.Eventual[0].Name != "Kept" {
+		t.Errorf("undo left %d tasks\n%s", len(fl.Eventual), b.String())
+	}
+	if !strings.Contains(b.String(), "\n"+broken+"\n") {
+		t.Errorf("%q not kept after undo\n%s", broken, b.String())
+	}
+}
+
+// TestReadTodoTxtRecurrence checks that recurrences are read as other
+// programs write them, and that lines which cannot be read are kept.
+func TestReadTodoTxtRecurrence(t *testing.T) {
+	const text = `(A) Pay rent due:2026-11-01 rec:+1m
+Water plants due:2026-11-01 rec:1m
+Stand-up due:2026-11-02 rec:+1b
+Renew passport due:2026-11-01 rec:+2y
+Stretch due:2026-11-01 rec:3d
++someday
+Broken due:tomorrow
+`
+	fl, err := ReadTodoTxt(bytes.NewReader([]byte(text)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const day = 24 * time.Hour
+	tests := []struct {
+		rule            string
+		delay           time.Duration
+		afterCompletion bool
+		rec             string
+	}{
+		{"FREQ=MONTHLY", 0, false, "rec:+1m"},
+		{"", 30 * day, true, "rec:30d"},
+		{todoTxtWeekdays, 0, false, "rec:+1b"},
+		{"FREQ=YEARLY;INTERVAL=2", 0, false, "rec:+2y"},
+		{"", 3 * day, true, "rec:3d"},
+	}
+	if len(fl.Recurring) != len(tests) {
+		t.Fatalf("read %d recurring tasks, want %d", len(fl.Recurring),
+			len(tests))
+	}
+	for i, test := range tests {
+		g := fl.Recurring[i]
+		var rule string
+		if g.Rule != nil {
+			rule = g.Rule.String()
+		}
+		var delay time.Duration
+		if len(g.Delay) == 1 {
+			delay = g.Delay[0]
+		}
+		if rule != test.rule || delay != test.delay ||
+			g.AfterCompletion != test.afterCompletion {
+
+			t.Errorf("%s read as rule %q, delays %v, after completion %t",
+				g.Spawn.Name, rule, g.Delay, g.AfterCompletion)
+		}
+		line := todoTxtTask(g, nil)
+		if !strings.Contains(line, " "+test.rec+" ") {
+			t.Errorf("%s written as %q, want %s", g.Spawn.Name, line,
+				test.rec)
+		}
+	}
+
+	if len(fl.unread) != 2 {
+		t.Fatalf("kept %d unread lines, want 2", len(fl.unread))
+	}
+	var b bytes.Buffer
+	if err := fl.WriteTodoTxt(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"+someday", "Broken due:tomorrow"} {
+		if !strings.Contains(b.String(), "\n"+line+"\n") {
+			t.Errorf("%q not written back\n%s", line, b.String())
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// UrgencyDefault and UrgencyWeighted name the UrgencyModels which
+	// may be selected by the "urgency" setting.
+	UrgencyDefault  = "default"
+	UrgencyWeighted = "weighted"
+
+	// WeightedNiceScale is the number by which weighted urgencies are
+	// multiplied to produce nice values.
+	WeightedNiceScale = 1000
+)
+
+var (
+	// DefaultCoefficients weight each term of the WeightedUrgency
+	// unless they are configured otherwise.
+	DefaultCoefficients = map[string]float64{
+		"due":      12,
+		"priority": 6,
+		"age":      2,
+		"tags":     1,
+		"project":  1,
+		"blocking": 8,
+		"blocked":  -5,
+		"tag.next": 15,
+	}
+
+	// DefaultMaxAge is the age at which the age term of the
+	// WeightedUrgency is greatest, unless configured otherwise.
+	DefaultMaxAge = 365 * 24 * time.Hour
+)
+
+// UrgencyModel calculates how urgent Tasks are, so that they can be
+// sorted.
+type UrgencyModel interface {
+	// Nice returns the nice value of the Task at the given time, with
+	// lower values meaning greater urgency.
+	Nice(t Task, now time.Time) int
+
+	// Explain breaks the urgency of the Task at the given time down
+	// into the terms it is made of.
+	Explain(t Task, now time.Time) []UrgencyTerm
+}
+
+// UrgencyTerm is a single part of the urgency of a Task, which is the
+// product of a Factor describing the task and a Coefficient weighting
+// it.
+type UrgencyTerm struct {
+	Name                string
+	Factor, Coefficient float64
+}
+
+// Value returns the amount which the term contributes to the urgency.
+func (term UrgencyTerm) Value() float64 {
+	return term.Factor * term.Coefficient
+}
+
+// NewUrgencyModel creates the UrgencyModel named by the "urgency"
+// setting of the Config, configured by its other settings.
+func NewUrgencyModel(c Config) (UrgencyModel, error) {
+	switch name := strings.ToLower(c.String("urgency", UrgencyDefault)); name {
+	case UrgencyDefault:
+		return newDefaultUrgency(c)
+	case UrgencyWeighted:
+		return newWeightedUrgency(c)
+	default:
+		return nil, fmt.Errorf("unknown urgency model %q", name)
+	}
+}
+
+// urgency returns the UrgencyModel of the global Context, or the
+// DefaultUrgency if it has none.
+func urgency() UrgencyModel {
+	if Ctx != nil && Ctx.Urgency != nil {
+		return Ctx.Urgency
+	}
+	return DefaultUrgency{Eventual: EventualFactor * time.Second}
+}
+
+// configDuration returns the named setting as a duration, in any form
+// understood by ParseDelays, or def if it is not set.
+func configDuration(c Config, name string, def time.Duration) (
+	time.Duration, error) {
+
+	value, ok := c[name]
+	if !ok {
+		return def, nil
+	}
+	delays, err := ParseDelays(value)
+	if err != nil || len(delays) != 1 {
+		return def, fmt.Errorf("invalid duration for %s: %q", name, value)
+	}
+	return delays[0], nil
+}
+
+// DefaultUrgency calculates the nice values of tasks with due dates as
+//
+//	priority * secondsin(due - now)
+//
+// so that they become more urgent as they become due, and those with
+// lower priorities sooner. Once tasks are overdue, the seconds are
+// divided by the priority instead, so that those with lower priorities
+// remain more urgent. Eventual tasks are treated as being due the
+// Eventual duration from now, multiplied by their priority.
+type DefaultUrgency struct {
+	Eventual time.Duration
+}
+
+// newDefaultUrgency creates a DefaultUrgency, with the Eventual
+// duration given by the "urgency.eventual" setting.
+func newDefaultUrgency(c Config) (u DefaultUrgency, err error) {
+	u.Eventual, err = configDuration(c, "urgency.eventual",
+		EventualFactor*time.Second)
+	return
+}
+
+// Nice sums the terms given by Explain.
+func (u DefaultUrgency) Nice(t Task, now time.Time) int {
+	var nice float64
+	for _, term := range u.Explain(t, now) {
+		nice += term.Value()
+	}
+	return int(nice)
+}
+
+// Explain produces a single term, in which the Factor is the number of
+// seconds until the task is due, and the Coefficient its priority or
+// the inverse of it.
+func (u DefaultUrgency) Explain(t Task, now time.Time) []UrgencyTerm {
+	info := t.Info()
+	priority := float64(info.Priority)
+	if priority < 1 {
+		priority = 1
+	}
+
+	if info.DueBy.IsZero() {
+		return []UrgencyTerm{{"eventual", u.Eventual.Seconds(), priority}}
+	}
+	due := float64(info.DueBy.Sub(now) / time.Second)
+	if due < 0 {
+		return []UrgencyTerm{{"overdue", due, 1 / priority}}
+	}
+	return []UrgencyTerm{{"due", due, priority}}
+}
+
+// WeightedUrgency calculates the urgency of tasks as a weighted sum of
+// terms describing them, each between 0 and 1, in the manner of
+// Taskwarrior. Greater urgencies mean lower nice values. The terms are
+//
+//	due       how near the due date is, from 0.2 two weeks before
+//	          it to 1 a week after it
+//	priority  the inverse of the priority
+//	age       the time since the task was created, up to MaxAge
+//	tags      0.8, 0.9, or 1 for one, two, or more tags
+//	project   whether the task belongs to a project
+//	blocking  whether other tasks depend on the task
+//	blocked   whether the task depends on others
+//	tag.name  whether the task has the tag
+//
+// and their Coefficients are given by name. Terms without
+// Coefficients are left out.
+type WeightedUrgency struct {
+	Coefficients map[string]float64
+	MaxAge       time.Duration
+}
+
+// newWeightedUrgency creates a WeightedUrgency with the
+// DefaultCoefficients, replaced by any settings such as
+// "urgency.due.coefficient", and the MaxAge given by the
+// "urgency.age.max" setting.
+func newWeightedUrgency(c Config) (u WeightedUrgency, err error) {
+	u.Coefficients = make(map[string]float64, len(DefaultCoefficients))
+	for name, coefficient := range DefaultCoefficients {
+		u.Coefficients[name] = coefficient
+	}
+	for _, name := range c.Prefixed("urgency.", ".coefficient") {
+		u.Coefficients[name], err = c.Float(
+			"urgency."+name+".coefficient", 0)
+		if err != nil {
+			return
+		}
+	}
+
+	u.MaxAge, err = configDuration(c, "urgency.age.max", DefaultMaxAge)
+	return
+}
+
+// Nice negates the sum of the terms given by Explain, and scales it by
+// WeightedNiceScale.
+func (u WeightedUrgency) Nice(t Task, now time.Time) int {
+	var urgency float64
+	for _, term := range u.Explain(t, now) {
+		urgency += term.Value()
+	}
+	return -int(urgency * WeightedNiceScale)
+}
+
+// Explain produces the terms which apply to the task, in a fixed
+// order, followed by those of its tags.
+func (u WeightedUrgency) Explain(t Task, now time.Time) (
+	terms []UrgencyTerm) {
+
+	info := t.Info()
+	factors := []struct {
+		name   string
+		factor float64
+	}{
+		{"due", dueFactor(info.DueBy, now)},
+		{"priority", priorityFactor(info.Priority)},
+		{"age", ageFactor(info.Created, now, u.MaxAge)},
+		{"tags", tagsFactor(len(info.Tags))},
+		{"project", boolFactor(info.Project != "")},
+		{"blocking", boolFactor(len(info.dependents) > 0)},
+		{"blocked", boolFactor(len(info.blockers) > 0)},
+	}
+	for _, f := range factors {
+		coefficient, ok := u.Coefficients[f.name]
+		if ok && f.factor != 0 {
+			terms = append(terms, UrgencyTerm{f.name, f.factor, coefficient})
+		}
+	}
+
+	tags := append([]string(nil), info.Tags...)
+	sort.Strings(tags)
+	for _, tag := range tags {
+		name := "tag." + strings.ToLower(tag)
+		if coefficient, ok := u.Coefficients[name]; ok {
+			terms = append(terms, UrgencyTerm{name, 1, coefficient})
+		}
+	}
+	return
+}
+
+// dueFactor rises linearly from 0.2, two weeks before the due date, to
+// 1, a week after it. Eventual tasks have no due factor.
+func dueFactor(due, now time.Time) float64 {
+	if due.IsZero() {
+		return 0
+	}
+	days := due.Sub(now).Hours() / 24
+	switch {
+	case days <= -7:
+		return 1
+	case days >= 14:
+		return 0.2
+	}
+	return 0.2 + 0.8*(14-days)/21
+}
+
+// priorityFactor is the inverse of the priority, so that the lowest
+// priority, 1, is the most urgent.
+func priorityFactor(priority int) float64 {
+	if priority < 1 {
+		return 0
+	}
+	return 1 / float64(priority)
+}
+
+// ageFactor is the fraction of the maximum age which has passed since
+// the task was created.
+func ageFactor(created, now time.Time, max time.Duration) float64 {
+	if created.IsZero() || max <= 0 {
+		return 0
+	}
+	age := float64(now.Sub(created)) / float64(max)
+	if age > 1 {
+		return 1
+	} else if age < 0 {
+		return 0
+	}
+	return age
+}
+
+// tagsFactor increases with the number of tags, up to three.
+func tagsFactor(n int) float64 {
+	switch {
+	case n == 0:
+		return 0
+	case n == 1:
+		return 0.8
+	case n == 2:
+		return 0.9
+	}
+	return 1
+}
+
+// boolFactor is 1 if the condition holds, and 0 otherwise.
+func boolFactor(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (c *Command) CmdWhy(ctx *Context) (err error) {
+	glog.V(2).Infoln("User invoked why")
+
+	task, err := ctx.List.Find(strings.Join(c.Args, " "))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(ctx.Output, "%4s %s", task.Info().Alias, task.String())
+
+	var total float64
+	for _, term := range urgency().Explain(task, ctx.Now()) {
+		fmt.Fprintf(ctx.Output, "\t%-14s %14.3f * %9.3f = %14.3f\n",
+			term.Name, term.Factor, term.Coefficient, term.Value())
+		total += term.Value()
+	}
+	fmt.Fprintf(ctx.Output, "\t%-14s %44.3f\n", "total", total)
+	fmt.Fprintf(ctx.Output, "\tnice %d\n", task.Nice())
+
+	// Tasks which block others are listed no later than them, so
+	// their position may not follow from their own nice value.
+	if dependents := task.Metadata().dependents; len(dependents) > 0 {
+		fmt.Fprintf(ctx.Output, "\tlisted no later than the tasks "+
+			"depending on it: %s\n", blockerAliases(dependents))
+	}
+	return nil
+}